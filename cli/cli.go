@@ -1,37 +1,41 @@
 package cli
 
 import (
+	"crypto/tls"
 	"encoding/json"
-	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
 	"time"
 
-	"github.com/cheggaaa/pb"
 	"github.com/dogestry/dogestry/config"
 	"github.com/dogestry/dogestry/remote"
+	"github.com/dogestry/dogestry/utils"
 	docker "github.com/fsouza/go-dockerclient"
 	homedir "github.com/mitchellh/go-homedir"
 )
 
-func newDockerClient(host string) (*docker.Client, error) {
-	var err error
-	var newClient *docker.Client
+// partial downloads untouched for this long won't be resumed. A new version
+// of the file is a different partial, so the old one would stay forever.
+const partialExpiry = 24 * time.Hour
+
+// Where the TLS certificates for docker are: DOCKER_CERT_PATH, or ~/.docker if
+// it has them all. Empty if there are none.
+func dockerCertPath() string {
 	dockerCertPath := os.Getenv("DOCKER_CERT_PATH")
 
 	homeDir, _ := homedir.Dir()
 	dockerConfigDir := path.Join(homeDir, ".docker")
 
-	_, err = os.Stat(path.Join(dockerConfigDir, "cert.pem"))
+	_, err := os.Stat(path.Join(dockerConfigDir, "cert.pem"))
 	certExists := err == nil
 
 	_, err = os.Stat(path.Join(dockerConfigDir, "ca.pem"))
@@ -44,7 +48,14 @@ func newDockerClient(host string) (*docker.Client, error) {
 		dockerCertPath = dockerConfigDir
 	}
 
-	if dockerCertPath != "" {
+	return dockerCertPath
+}
+
+func newDockerClient(host string) (*docker.Client, error) {
+	var err error
+	var newClient *docker.Client
+
+	if dockerCertPath := dockerCertPath(); dockerCertPath != "" {
 		cert := path.Join(dockerCertPath, "cert.pem")
 		key := path.Join(dockerCertPath, "key.pem")
 		ca := path.Join(dockerCertPath, "ca.pem")
@@ -60,6 +71,45 @@ func newDockerClient(host string) (*docker.Client, error) {
 	return newClient, err
 }
 
+// TLS config for the docker hosts, nil if they're not using TLS
+func dockerTLSConfig() (*tls.Config, error) {
+	dockerCertPath := dockerCertPath()
+	if dockerCertPath == "" {
+		return nil, nil
+	}
+
+	return utils.ClientTLSConfig(path.Join(dockerCertPath, "cert.pem"),
+		path.Join(dockerCertPath, "key.pem"), path.Join(dockerCertPath, "ca.pem"))
+}
+
+// TLS config for the dogestry servers, nil if they're not using TLS.
+// Certificates not set with -tlscert, -tlskey and -tlscacert are taken from
+// the docker cert path, as for the docker hosts.
+func (cli *DogestryCli) serverTLSConfig() (*tls.Config, error) {
+	if !cli.Config.TLS.Enabled {
+		return nil, nil
+	}
+
+	cert, key, ca := cli.Config.TLS.Cert, cli.Config.TLS.Key, cli.Config.TLS.CACert
+
+	if dockerCertPath := dockerCertPath(); dockerCertPath != "" {
+		if cert == "" && key == "" && fileExists(path.Join(dockerCertPath, "cert.pem")) {
+			cert = path.Join(dockerCertPath, "cert.pem")
+			key = path.Join(dockerCertPath, "key.pem")
+		}
+		if ca == "" && fileExists(path.Join(dockerCertPath, "ca.pem")) {
+			ca = path.Join(dockerCertPath, "ca.pem")
+		}
+	}
+
+	return utils.ClientTLSConfig(cert, key, ca)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
 func NewDogestryCli(cfg config.Config, hosts []string, tempDirRoot string) (*DogestryCli, error) {
 	var err error
 
@@ -85,6 +135,15 @@ func NewDogestryCli(cfg config.Config, hosts []string, tempDirRoot string) (*Dog
 		}
 	}
 
+	// interrupted downloads are resumed by the next pull, so they're kept
+	// outside of the pull's own temp dir
+	partialRoot := dogestryCli.TempDirRoot
+	if partialRoot == "" {
+		partialRoot = os.TempDir()
+	}
+	dogestryCli.Config.PartialDir = filepath.Join(partialRoot, "dogestry-partial")
+	expirePartials(dogestryCli.Config.PartialDir, time.Now().Add(-partialExpiry))
+
 	dogestryCli.Client, err = newDockerClient(dogestryCli.DockerHost)
 	if err != nil {
 		log.Fatal(err)
@@ -189,6 +248,22 @@ func (cli *DogestryCli) WorkDir(suffix string) (string, error) {
 	return cli.WorkDirGivenBaseDir(basedir, suffix)
 }
 
+// Remove the partial downloads in dir last written before olderThan
+func expirePartials(dir string, olderThan time.Time) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, file := range files {
+		if !file.IsDir() && file.ModTime().Before(olderThan) {
+			if err := os.Remove(filepath.Join(dir, file.Name())); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
 // clean up the tempDir
 func (cli *DogestryCli) Cleanup() {
 	if cli.TempDir != "" {
@@ -225,48 +300,36 @@ func (cli *DogestryCli) getLayerIdsToDownload(fromId remote.ID, imageRoot string
 	return toDownload, err
 }
 
-func (cli *DogestryCli) pullImage(fromId remote.ID, imageRoot string, r remote.Remote) error {
-	toDownload, err := cli.getLayerIdsToDownload(fromId, imageRoot, r, cli.Client)
-	if err != nil {
+func (cli *DogestryCli) createRepositoriesJsonFile(image, imageRoot string, r remote.Remote) error {
+	repositories, err := repositoriesFor(image, r)
+	if err != nil || repositories == nil {
 		return err
 	}
 
-	for _, id := range toDownload {
-		downloadPath := filepath.Join(imageRoot, string(id))
-
-		fmt.Printf("Pulling image id '%s' to: %v\n", id.Short(), downloadPath)
-
-		err := r.PullImageId(id, downloadPath)
-		if err != nil {
-			return err
-		}
+	reposPath := filepath.Join(imageRoot, "repositories")
+	reposFile, err := os.Create(reposPath)
+	if err != nil {
+		return err
 	}
+	defer reposFile.Close()
 
-	return nil
+	return json.NewEncoder(reposFile).Encode(&repositories)
 }
 
-func (cli *DogestryCli) createRepositoriesJsonFile(image, imageRoot string, r remote.Remote) error {
+// The repositories file tagging a legacy image, nil if the tag doesn't exist
+func repositoriesFor(image string, r remote.Remote) (map[string]Repository, error) {
 	repoName, repoTag := remote.NormaliseImageName(image)
 
 	id, err := r.ParseTag(repoName, repoTag)
-	if err != nil {
-		return err
-	} else if id == "" {
-		return nil
+	if err != nil || id == "" {
+		return nil, err
 	}
 
-	reposPath := filepath.Join(imageRoot, "repositories")
-	reposFile, err := os.Create(reposPath)
-	if err != nil {
-		return err
-	}
-	defer reposFile.Close()
-
 	repositories := map[string]Repository{}
 	repositories[repoName] = Repository{}
 	repositories[repoName][repoTag] = string(id)
 
-	return json.NewEncoder(reposFile).Encode(&repositories)
+	return repositories, nil
 }
 
 type Status struct {
@@ -276,11 +339,11 @@ type Status struct {
 }
 
 // makeStatusJSON returns status JSON
-func (cli *DogestryCli) makeStatusJSON(errMap map[string]error) ([]byte, error) {
-	var statusMap = make([]Status, len(cli.PullHosts))
+func (cli *DogestryCli) makeStatusJSON(hosts []string, errMap map[string]error) ([]byte, error) {
+	var statusMap = make([]Status, len(hosts))
 	var status Status
 
-	for i, host := range cli.PullHosts {
+	for i, host := range hosts {
 		status.Host = host
 
 		if val, ok := errMap[host]; ok {
@@ -288,6 +351,7 @@ func (cli *DogestryCli) makeStatusJSON(errMap map[string]error) ([]byte, error)
 			status.Error = val.Error()
 		} else {
 			status.Status = "ok"
+			status.Error = ""
 		}
 
 		statusMap[i] = status
@@ -295,87 +359,46 @@ func (cli *DogestryCli) makeStatusJSON(errMap map[string]error) ([]byte, error)
 	return json.Marshal(statusMap)
 }
 
-func (cli *DogestryCli) outputStatus(errMap map[string]error) error {
-	result, err := cli.makeStatusJSON(errMap)
+// outputStatus prints the status of every host and fails the pull unless
+// enough of them loaded the image (see -min-success).
+func (cli *DogestryCli) outputStatus(hosts []string, errMap map[string]error) error {
+	result, err := cli.makeStatusJSON(hosts, errMap)
 	if err != nil {
 		return err
 	}
 	fmt.Println(string(result[:]))
-	return nil
+
+	return cli.checkMinSuccess(len(hosts), len(errMap))
 }
 
-// sendTar streams exported tarball into remote docker hosts
-func (cli *DogestryCli) sendTar(imageRoot string) error {
-	type hostErrTuple struct {
-		host string
-		err  error
+func (cli *DogestryCli) checkMinSuccess(hosts, failed int) error {
+	if failed == 0 {
+		return nil
 	}
 
-	type placeboProgressBar struct {
-		count int
-		bar   *pb.ProgressBar
+	required := cli.Config.MinSuccess
+	if required <= 0 || required > hosts {
+		required = hosts
 	}
 
-	// Avoid displaying the progress bar if dogestry is running in server mode
-	if !cli.Config.ServerMode {
-		progressBar := &placeboProgressBar{1000, pb.StartNew(1000)}
-		progressBar.bar.ShowCounters = false
-
-		// Starts the placebo progress bar
-		go func(progressBar *placeboProgressBar) {
-			for {
-				progressBar.bar.Increment()
-				time.Sleep(time.Second)
-			}
-		}(progressBar)
+	if hosts-failed < required {
+		return fmt.Errorf("Pull failed on %d of %d hosts, %d had to succeed", failed, hosts, required)
 	}
 
-	tupleCh := make(chan hostErrTuple)
-
-	for i, client := range cli.PullClients {
-		host := cli.PullHosts[i]
-
-		go func(client *docker.Client, host string) {
-			cmd := exec.Command("tar", "cvf", "-", "-C", imageRoot, ".")
-			cmd.Env = os.Environ()
-			cmd.Dir = imageRoot
-			defer cmd.Wait()
-
-			stdout, err := cmd.StdoutPipe()
-			if err != nil {
-				tupleCh <- hostErrTuple{host, err}
-				return
-			}
-
-			if err := cmd.Start(); err != nil {
-				tupleCh <- hostErrTuple{host, err}
-				return
-			}
-
-			err = client.LoadImage(docker.LoadImageOptions{InputStream: stdout})
-			if err != nil {
-				tupleCh <- hostErrTuple{host, err}
-				return
-			}
-			tupleCh <- hostErrTuple{"", nil}
-
-		}(client, host)
-	}
+	fmt.Printf("Pull failed on %d of %d hosts, %d had to succeed\n", failed, hosts, required)
+	return nil
+}
 
-	uploadImageErrMap := make(map[string]error)
-	for range cli.PullClients {
-		tuple := <-tupleCh
-		if tuple.err != nil {
-			uploadImageErrMap[tuple.host] = tuple.err
-		}
+// sendTar streams the image files in imageRoot into the docker hosts
+func (cli *DogestryCli) sendTar(imageRoot string) error {
+	total, err := tarDirSize(imageRoot)
+	if err != nil {
+		return err
 	}
-	close(tupleCh)
 
-	err := cli.outputStatus(uploadImageErrMap)
-	if len(uploadImageErrMap) > 0 {
-		err = errors.New("Error in sendTar")
-	}
-	return err
+	return cli.loadTar(total, func(w io.Writer) error {
+		return writeTarDir(w, imageRoot)
+	})
 }
 
 type DownloadMap map[remote.ID][]string
@@ -399,23 +422,37 @@ func (cli *DogestryCli) makeDownloadMap(r remote.Remote, id remote.ID, imageRoot
 	return downloadMap, err
 }
 
+// Pull the images in downloadMap, and their layers. Images and layers are
+// pulled in parallel, the remote keeps the files transferred at once within
+// -concurrency. Fails with the errors of every image that couldn't be pulled.
 func (cli *DogestryCli) downloadImages(r remote.Remote, downloadMap DownloadMap, imageRoot string) error {
-	pullImagesErrMap := make(map[string]error)
+	ids := make([]string, 0, len(downloadMap))
+	for id := range downloadMap {
+		ids = append(ids, string(id))
+	}
+	sort.Strings(ids)
 
-	for id, _ := range downloadMap {
+	pullImagesErrMap := utils.Parallel(cli.Config.Concurrency, ids, func(name string) error {
+		id := remote.ID(name)
 		downloadPath := filepath.Join(imageRoot, string(id))
 
 		fmt.Printf("Pulling image id '%s' to: %v\n", id.Short(), downloadPath)
 
-		err := r.PullImageId(id, downloadPath)
-		if err != nil {
-			pullImagesErrMap[downloadPath] = err
+		if err := r.PullImageId(id, downloadPath); err != nil {
+			return err
 		}
-	}
+
+		return cli.pullV2Layers(r, id, imageRoot)
+	})
 
 	if len(pullImagesErrMap) > 0 {
-		fmt.Printf("Errors pulling images: %v\n", pullImagesErrMap)
-		return fmt.Errorf("Error downloading files from S3")
+		fmt.Println("Errors pulling images:")
+		for _, id := range ids {
+			if err, ok := pullImagesErrMap[id]; ok {
+				fmt.Printf("  %s: %v\n", remote.ID(id).Short(), err)
+			}
+		}
+		return fmt.Errorf("Error downloading %d of %d images from %s", len(pullImagesErrMap), len(ids), r.Desc())
 	}
 
 	return nil
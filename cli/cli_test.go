@@ -1,10 +1,16 @@
 package cli
 
 import (
+	"errors"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/dogestry/dogestry/config"
+	"github.com/dogestry/dogestry/remote"
 )
 
 const (
@@ -51,3 +57,125 @@ func TestCreateAndReturnTempDirAndCleanup(t *testing.T) {
 		t.Fatalf("Cleanup() should remove tmp directory. tmpDir: %v", tmpDir)
 	}
 }
+
+func TestExpirePartials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dogestry-partial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	longAgo := time.Now().Add(-2 * partialExpiry)
+	for _, name := range []string{"stale", "fresh"} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if name == "stale" {
+			if err := os.Chtimes(path, longAgo, longAgo); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	expirePartials(dir, time.Now().Add(-partialExpiry))
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 || files[0].Name() != "fresh" {
+		t.Errorf("only the stale partial should be removed, got %v", files)
+	}
+
+	// nothing to expire yet
+	expirePartials(filepath.Join(dir, "missing"), time.Now())
+}
+
+func TestDownloadImagesReportsEveryFailure(t *testing.T) {
+	remoteDir, err := ioutil.TempDir("", "dogestry-remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(remoteDir)
+
+	for _, name := range []string{"json", "layer.tar", "VERSION"} {
+		path := filepath.Join(remoteDir, "images", "abc123", name)
+		os.MkdirAll(filepath.Dir(path), 0700)
+		ioutil.WriteFile(path, []byte(name), 0600)
+	}
+
+	cfg, _ := config.NewConfig(false, 22375, false, false, false)
+	cfg.SetS3URL(remoteDir)
+	cfg.Concurrency = 2
+
+	dogestryCli, _ := NewDogestryCli(cfg, hosts, testTmpDirRoot)
+	defer dogestryCli.Cleanup()
+
+	r, err := remote.NewRemote(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imageRoot, _ := dogestryCli.CreateAndReturnTempDir()
+
+	downloadMap := DownloadMap{"abc123": nil, "missing1": nil, "missing2": nil}
+
+	err = dogestryCli.downloadImages(r, downloadMap, imageRoot)
+	if err == nil || !strings.HasPrefix(err.Error(), "Error downloading 2 of 3 images") {
+		t.Fatalf("both missing images should be reported. Error: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(imageRoot, "abc123", "layer.tar")); err != nil {
+		t.Errorf("abc123 should still be pulled. Error: %v", err)
+	}
+}
+
+func TestParseMinSuccess(t *testing.T) {
+	valid := map[string]int{"": 0, "1": 1, "3": 3, "50%": 2, "100%": 3, "1%": 1}
+	for value, expected := range valid {
+		if n, err := parseMinSuccess(value, 3); err != nil || n != expected {
+			t.Errorf("-min-success %q of 3 hosts should be %d, got %d. Error: %v", value, expected, n, err)
+		}
+	}
+
+	for _, value := range []string{"0", "4", "-1", "101%", "half", "%"} {
+		if _, err := parseMinSuccess(value, 3); err == nil {
+			t.Errorf("-min-success %q of 3 hosts should be invalid", value)
+		}
+	}
+}
+
+func TestOutputStatusMinSuccess(t *testing.T) {
+	pullHosts := []string{"tcp://host-1:2375", "tcp://host-2:2375", "tcp://host-3:2375"}
+	errMap := map[string]error{"tcp://host-2:2375": errors.New("connection refused")}
+
+	dogestryCli := &DogestryCli{}
+	if err := dogestryCli.outputStatus(pullHosts, errMap); err == nil {
+		t.Error("by default a pull should fail if any host fails")
+	}
+
+	dogestryCli.Config.MinSuccess = 2
+	if err := dogestryCli.outputStatus(pullHosts, errMap); err != nil {
+		t.Errorf("a pull reaching -min-success should succeed. Error: %v", err)
+	}
+
+	errMap["tcp://host-3:2375"] = errors.New("no space left on device")
+	if err := dogestryCli.outputStatus(pullHosts, errMap); err == nil {
+		t.Error("a pull short of -min-success should fail")
+	}
+}
+
+func TestMakeStatusJSON(t *testing.T) {
+	pullHosts := []string{"tcp://host-1:2375", "tcp://host-2:2375", "tcp://host-3:2375"}
+	errMap := map[string]error{"tcp://host-2:2375": errors.New("connection refused")}
+
+	result, err := (&DogestryCli{}).makeStatusJSON(pullHosts, errMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `[{"Host":"tcp://host-1:2375","Status":"ok"},` +
+		`{"Host":"tcp://host-2:2375","Status":"failed","Error":"connection refused"},` +
+		`{"Host":"tcp://host-3:2375","Status":"ok"}]`
+	if string(result) != expected {
+		t.Errorf("expected %s, got %s", expected, result)
+	}
+}
@@ -0,0 +1,132 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/dogestry/dogestry/remote"
+)
+
+const CopyHelpMessage string = `  Copy IMAGE[:TAG] from SRC_REMOTE to DST_REMOTE, without a docker daemon.
+
+  Only the images missing on DST_REMOTE are transferred, and the tag is
+  written last. The remotes can be in different regions, or of different
+  kinds (eg from S3 to a local directory).
+
+  Arguments:
+    SRC_REMOTE   Name of the remote to copy from.
+    DST_REMOTE   Name of the remote to copy to.
+    IMAGE[:TAG]  Name of IMAGE. TAG is optional, and defaults to 'latest'.
+
+  Examples:
+    dogestry copy s3://staging-bucket/images/?region=us-east-1 s3://prod-bucket/images/?region=eu-west-1 ubuntu:14.04
+    dogestry copy s3://staging-bucket/images/ /mnt/docker-images ubuntu`
+
+const SyncHelpMessage string = `  Copy every tag on SRC_REMOTE to DST_REMOTE, without a docker daemon.
+
+  Tags already pointing to the same image on DST_REMOTE are skipped.
+
+  Arguments:
+    SRC_REMOTE   Name of the remote to copy from.
+    DST_REMOTE   Name of the remote to copy to.
+
+  Examples:
+    dogestry sync s3://staging-bucket/images/?region=us-east-1 s3://prod-bucket/images/?region=eu-west-1`
+
+func (cli *DogestryCli) CmdCopy(args ...string) error {
+	copyFlags := cli.Subcmd("copy", "SRC_REMOTE DST_REMOTE IMAGE[:TAG]", CopyHelpMessage)
+	if err := copyFlags.Parse(args); err != nil {
+		return nil
+	}
+
+	if len(copyFlags.Args()) < 3 {
+		fmt.Fprintln(cli.err, "Error: SRC_REMOTE, DST_REMOTE and IMAGE not specified")
+		copyFlags.Usage()
+		os.Exit(2)
+	}
+
+	copier, err := cli.newCopier(copyFlags.Arg(0), copyFlags.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	repoName, repoTag := remote.NormaliseImageName(copyFlags.Arg(2))
+
+	copied, err := copier.CopyTag(repoName, repoTag)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Copied %s:%s (%d images)\n", repoName, repoTag, copied)
+	return nil
+}
+
+func (cli *DogestryCli) CmdSync(args ...string) error {
+	syncFlags := cli.Subcmd("sync", "SRC_REMOTE DST_REMOTE", SyncHelpMessage)
+	if err := syncFlags.Parse(args); err != nil {
+		return nil
+	}
+
+	if len(syncFlags.Args()) < 2 {
+		fmt.Fprintln(cli.err, "Error: SRC_REMOTE and DST_REMOTE not specified")
+		syncFlags.Usage()
+		os.Exit(2)
+	}
+
+	copier, err := cli.newCopier(syncFlags.Arg(0), syncFlags.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	images, err := copier.Src.List()
+	if err != nil {
+		return err
+	}
+
+	total := 0
+	for _, image := range images {
+		copied, err := copier.CopyTag(image.Repository, image.Tag)
+		if err != nil {
+			return fmt.Errorf("%s:%s: %v", image.Repository, image.Tag, err)
+		}
+
+		if copied > 0 {
+			fmt.Printf("Copied %s:%s (%d images)\n", image.Repository, image.Tag, copied)
+		}
+		total += copied
+	}
+
+	fmt.Printf("Synced %d tags (%d images copied)\n", len(images), total)
+	return nil
+}
+
+func (cli *DogestryCli) newCopier(srcURL, dstURL string) (*remote.Copier, error) {
+	src, err := cli.remoteFor(srcURL)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Source remote: %v\n", src.Desc())
+
+	dst, err := cli.remoteFor(dstURL)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Destination remote: %v\n", dst.Desc())
+
+	workDir, err := cli.CreateAndReturnTempDir()
+	if err != nil {
+		return nil, err
+	}
+
+	return remote.NewCopier(src, dst, workDir), nil
+}
+
+// a remote for url, leaving cli.Config alone since a copy needs two of them
+func (cli *DogestryCli) remoteFor(url string) (remote.Remote, error) {
+	cfg := cli.Config
+	if err := cfg.SetS3URL(url); err != nil {
+		return nil, err
+	}
+
+	return remote.NewRemote(cfg)
+}
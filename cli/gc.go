@@ -0,0 +1,139 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/dogestry/dogestry/remote"
+	"github.com/dogestry/dogestry/utils"
+)
+
+const GcHelpMessage string = `  Remove images and layers that no tag on REMOTE references.
+
+  Every image reachable from a tag is marked, everything else is removed.
+  Images modified within the grace period are kept, so that pushes still
+  in progress aren't collected. Tags are marked again right before
+  removing anything.
+
+  A push skips files the remote has already, without touching them. An old
+  unreferenced image pushed again is only safe once its tag is written: if
+  that happens between the second marking and the removal, the image is
+  removed anyway. Push it again then, or run gc when nothing is pushing.
+
+  Arguments:
+    REMOTE       Name of REMOTE.
+
+  Options:
+    -grace       Keep unreferenced files younger than this (default: 24h)
+    -dry-run     Print what would be removed, without removing it
+
+  Examples:
+    dogestry gc s3://DockerBucket/Path/?region=us-east-1
+    dogestry gc -dry-run -grace 1h /path/to/images`
+
+func (cli *DogestryCli) CmdGc(args ...string) error {
+	gcFlags := cli.Subcmd("gc", "[OPTIONS] REMOTE", GcHelpMessage)
+	grace := gcFlags.Duration("grace", 24*time.Hour, "keep unreferenced files younger than this")
+	dryRun := gcFlags.Bool("dry-run", false, "only print what would be removed")
+	if err := gcFlags.Parse(args); err != nil {
+		return nil
+	}
+
+	if len(gcFlags.Args()) < 1 {
+		fmt.Fprintln(cli.err, "Error: REMOTE not specified")
+		gcFlags.Usage()
+		os.Exit(2)
+	}
+
+	S3URL := gcFlags.Arg(0)
+
+	cli.Config.SetS3URL(S3URL)
+
+	r, err := remote.NewRemote(cli.Config)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Remote: %v\n", r.Desc())
+
+	// take the cutoff before marking, anything pushed while we mark is kept
+	olderThan := time.Now().Add(-*grace)
+
+	fmt.Println("Marking images referenced by tags...")
+	refs, err := remote.FindReferences(r)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("  %d images and %d layers in use\n", len(refs.Images), len(refs.Layers))
+
+	fmt.Println("Sweeping unreferenced images and layers...")
+	garbage, err := remote.FindGarbage(r, refs, olderThan)
+	if err != nil {
+		return err
+	}
+
+	return sweep(r, garbage, olderThan, *dryRun)
+}
+
+// sweep removes the garbage, less anything modified after olderThan. Tags are
+// marked again right before removing, and what they reach now is kept:
+// pushes skip files the remote has already, so an old image may have been
+// tagged again meanwhile.
+func sweep(r remote.Remote, garbage []remote.Garbage, olderThan time.Time, dryRun bool) error {
+	old := remote.OlderThan(garbage, olderThan)
+	if young := len(garbage) - len(old); young > 0 {
+		fmt.Printf("  %d modified within the grace period, kept\n", young)
+	}
+	garbage = old
+
+	if len(garbage) == 0 {
+		fmt.Println("Nothing to collect")
+		return nil
+	}
+
+	var reclaimed int64
+	keys := make([]string, 0)
+
+	for _, g := range garbage {
+		fmt.Printf("  %-80s %s\n", g.Prefix, utils.HumanSize(g.Size))
+		reclaimed += g.Size
+		keys = append(keys, g.Keys...)
+	}
+
+	if dryRun {
+		fmt.Printf("Would reclaim %s in %d keys\n", utils.HumanSize(reclaimed), len(keys))
+		return nil
+	}
+
+	fmt.Println("Marking again before removing...")
+	refs, err := remote.FindReferences(r)
+	if err != nil {
+		return err
+	}
+
+	unreferenced := remote.Unreferenced(garbage, refs)
+	if kept := len(garbage) - len(unreferenced); kept > 0 {
+		fmt.Printf("  %d tagged again since, kept\n", kept)
+	}
+
+	reclaimed = 0
+	keys = keys[:0]
+
+	for _, g := range unreferenced {
+		reclaimed += g.Size
+		keys = append(keys, g.Keys...)
+	}
+
+	if len(keys) == 0 {
+		fmt.Println("Nothing to collect")
+		return nil
+	}
+
+	if err := r.RemoveKeys(keys); err != nil {
+		return err
+	}
+
+	fmt.Printf("Reclaimed %s in %d keys\n", utils.HumanSize(reclaimed), len(keys))
+	return nil
+}
@@ -0,0 +1,61 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dogestry/dogestry/remote"
+)
+
+func TestSweepKeepsYoungAndRetaggedImages(t *testing.T) {
+	files := map[string]string{}
+	for _, id := range []string{"retagged", "orphan", "young"} {
+		files["images/"+id+"/json"] = `{"id":"` + id + `"}`
+		files["images/"+id+"/layer.tar"] = id + " layer"
+		files["images/"+id+"/VERSION"] = "1.0"
+	}
+
+	r, remoteDir := makeLocalRemote(t, files)
+	defer os.RemoveAll(remoteDir)
+
+	longAgo := time.Now().Add(-48 * time.Hour)
+	for name := range files {
+		if filepath.Base(filepath.Dir(name)) == "young" {
+			continue
+		}
+		for _, path := range []string{name, name + ".sum"} {
+			if err := os.Chtimes(filepath.Join(remoteDir, path), longAgo, longAgo); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	garbage := make([]remote.Garbage, 0)
+	for _, id := range []string{"retagged", "orphan", "young"} {
+		imageGarbage, err := remote.UnreferencedGarbage(r, remote.ID(id), remote.NewReferences())
+		if err != nil {
+			t.Fatal(err)
+		}
+		garbage = append(garbage, imageGarbage...)
+	}
+
+	// a push that skipped the unchanged files tags it after the garbage was found
+	if err := remote.WriteTag(r, "revived", "latest", "retagged", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sweep(r, garbage, time.Now().Add(-24*time.Hour), false); err != nil {
+		t.Fatal(err)
+	}
+
+	for id, kept := range map[string]bool{"retagged": true, "orphan": false, "young": true} {
+		_, err := os.Stat(filepath.Join(remoteDir, "images", id, "layer.tar"))
+		if kept && err != nil {
+			t.Errorf("%s should be kept. Error: %v", id, err)
+		} else if !kept && !os.IsNotExist(err) {
+			t.Errorf("%s should be removed", id)
+		}
+	}
+}
@@ -7,11 +7,20 @@ import (
 const HelpMessage string = `Usage: dogestry [OPTIONS] COMMAND [arg...]
 
   Commands:
+     copy             Copy IMAGE from one remote to another
+     gc               Remove images and layers no tag on remote references
      help             Print help message. Use help COMMAND for more specific help
+     history          Show the history of IMAGE on remote
+     inspect          Print the metadata of IMAGE on remote
      list             List images on remote
+     prune            Remove tags from remote according to a retention policy
      pull             Pull IMAGE from remote and load it into docker
      push             Push IMAGE from docker to remote
      remote           Show info about remote
+     rm               Remove IMAGE from remote
+     sync             Copy all tags from one remote to another
+     tag              Tag an image on remote, without moving any layers
+     verify           Check the files on remote against their digests
      version          Print version
      login            Add your AWS credentials to your .dockercfg (similar to 'docker login')
 
@@ -25,6 +34,19 @@ const HelpMessage string = `Usage: dogestry [OPTIONS] COMMAND [arg...]
      -force-local     Do *not* attempt to utilize remote Dogestry servers (default: false)
      -tempdir         What directory dogestry will use for stroring temporary files
      -disable-checks  Disable health checking of remote Docker hosts during 'pull'
+     -concurrency     How many files to push or pull at once (default: 25)
+     -retries         How many times to try an S3 operation before giving up (default: 5)
+     -retry-delay     Wait before retrying an S3 operation, doubled for each retry (default: 500ms)
+     -server-token    Token authenticating clients to dogestry servers (default: $DOGESTRY_SERVER_TOKEN)
+     -allowed-remotes A comma-separated list of remotes a dogestry server may pull from with its own credentials
+     -legacy-auth     Send (or as a dogestry server, accept) AWS credentials in the X-Registry-Auth header
+     -tls             Talk to dogestry servers over HTTPS, with the certificates in DOCKER_CERT_PATH unless given
+     -tlscert         TLS certificate of the dogestry server (or client)
+     -tlskey          TLS key of the dogestry server (or client)
+     -tlscacert       CA certificate to verify dogestry clients (or servers) with
+     -tlsverify       Require dogestry clients to present a certificate signed by -tlscacert
+     -registry-remote Serve the Docker registry API (v2) from this remote in server mode
+     -registry-push   Accept docker pushes to the registry API
 
   Typical S3 Usage:
      dogestry push s3://<bucket name>/<path name>/?region=us-east-1 <image name>
@@ -0,0 +1,149 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dogestry/dogestry/remote"
+	"github.com/dogestry/dogestry/utils"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+const HistoryHelpMessage string = `  Show the history of IMAGE as stored on REMOTE, newest image first.
+
+  Arguments:
+    REMOTE       Name of REMOTE.
+    IMAGE        Name of IMAGE (with an optional :TAG), or an image id. Short
+                 ids work too.
+
+  Options:
+    -format      "table" (default) or "json"
+
+  Examples:
+    dogestry history s3://DockerBucket/Path/?region=us-east-1 ubuntu:14.04
+    dogestry history -format json /path/to/images 5a1b2c3d4e5f`
+
+// An image in the history of another
+type historyEntry struct {
+	ID        string
+	Created   time.Time
+	CreatedBy string
+	Size      int64
+}
+
+func (cli *DogestryCli) CmdHistory(args ...string) error {
+	historyFlags := cli.Subcmd("history", "[OPTIONS] REMOTE IMAGE", HistoryHelpMessage)
+	format := historyFlags.String("format", "table", "'table' or 'json'")
+	if err := historyFlags.Parse(args); err != nil {
+		return nil
+	}
+
+	if len(historyFlags.Args()) < 2 {
+		fmt.Fprintln(cli.err, "Error: REMOTE and IMAGE not specified")
+		historyFlags.Usage()
+		os.Exit(2)
+	}
+
+	if *format != "json" && *format != "table" {
+		return fmt.Errorf("invalid -format %q, must be 'table' or 'json'", *format)
+	}
+
+	S3URL := historyFlags.Arg(0)
+	imageName := historyFlags.Arg(1)
+
+	cli.Config.SetS3URL(S3URL)
+
+	r, err := remote.NewRemote(cli.Config)
+	if err != nil {
+		return err
+	}
+
+	id, err := r.ResolveImageNameToId(imageName)
+	if err != nil {
+		return fmt.Errorf("%s: %v", imageName, err)
+	}
+
+	history := make([]historyEntry, 0)
+
+	err = r.WalkImages(id, func(id remote.ID, image docker.Image, err error) error {
+		if err != nil {
+			return fmt.Errorf("%s: %v", id.Short(), err)
+		}
+
+		size, err := layerSize(r, id)
+		if err != nil {
+			return err
+		}
+
+		history = append(history, historyEntry{
+			ID:        id.String(),
+			Created:   image.Created,
+			CreatedBy: strings.Join(image.ContainerConfig.Cmd, " "),
+			Size:      size,
+		})
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if *format == "json" {
+		return json.NewEncoder(os.Stdout).Encode(history)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintf(w, "IMAGE\tCREATED\tCREATED BY\tSIZE\n")
+
+	for _, entry := range history {
+		createdBy := entry.CreatedBy
+		if len(createdBy) > 60 {
+			createdBy = createdBy[:57] + "..."
+		}
+
+		line := fmt.Sprintf("%s\t%s\t%s\t%s", remote.ID(entry.ID).Short(), entry.Created.Format("2006-01-02 15:04:05"), createdBy, utils.HumanSize(entry.Size))
+		fmt.Fprintln(w, line)
+	}
+
+	return nil
+}
+
+// Size of the layers an image stores on the remote: its layer.tar for legacy
+// images, or all of its content addressed layers.
+func layerSize(r remote.Remote, id remote.ID) (int64, error) {
+	layers, err := r.ImageLayers(id)
+	if err != nil {
+		return 0, err
+	}
+
+	prefixes := make([]string, 0, len(layers))
+	for _, layer := range layers {
+		prefixes = append(prefixes, remote.LayerPrefix(layer))
+	}
+
+	if len(layers) == 0 {
+		prefixes = append(prefixes, remote.ImagePrefix(id)+"layer.tar")
+	}
+
+	var size int64
+	for _, prefix := range prefixes {
+		keyInfos, err := r.ListKeys(prefix)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, keyInfo := range keyInfos {
+			if strings.HasSuffix(keyInfo.Key, "layer.tar") {
+				size += keyInfo.Size
+			}
+		}
+	}
+
+	return size, nil
+}
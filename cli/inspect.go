@@ -0,0 +1,93 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/dogestry/dogestry/remote"
+)
+
+const InspectHelpMessage string = `  Print the metadata of IMAGE as stored on REMOTE.
+
+  Arguments:
+    REMOTE       Name of REMOTE.
+    IMAGE        Name of IMAGE (with an optional :TAG), or an image id. Short
+                 ids work too.
+
+  Options:
+    -format      "json" (default) or "table"
+
+  Examples:
+    dogestry inspect s3://DockerBucket/Path/?region=us-east-1 ubuntu:14.04
+    dogestry inspect -format table /path/to/images 5a1b2c3d4e5f`
+
+func (cli *DogestryCli) CmdInspect(args ...string) error {
+	inspectFlags := cli.Subcmd("inspect", "[OPTIONS] REMOTE IMAGE", InspectHelpMessage)
+	format := inspectFlags.String("format", "json", "'json' or 'table'")
+	if err := inspectFlags.Parse(args); err != nil {
+		return nil
+	}
+
+	if len(inspectFlags.Args()) < 2 {
+		fmt.Fprintln(cli.err, "Error: REMOTE and IMAGE not specified")
+		inspectFlags.Usage()
+		os.Exit(2)
+	}
+
+	if *format != "json" && *format != "table" {
+		return fmt.Errorf("invalid -format %q, must be 'json' or 'table'", *format)
+	}
+
+	S3URL := inspectFlags.Arg(0)
+	imageName := inspectFlags.Arg(1)
+
+	cli.Config.SetS3URL(S3URL)
+
+	r, err := remote.NewRemote(cli.Config)
+	if err != nil {
+		return err
+	}
+
+	id, err := r.ResolveImageNameToId(imageName)
+	if err != nil {
+		return fmt.Errorf("%s: %v", imageName, err)
+	}
+
+	image, err := r.ImageMetadata(id)
+	if err != nil {
+		return fmt.Errorf("%s: %v", id.Short(), err)
+	}
+
+	if *format == "json" {
+		data, err := json.MarshalIndent(image, "", "    ")
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(string(data))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintf(w, "ID\t%s\n", image.ID)
+	fmt.Fprintf(w, "Parent\t%s\n", image.Parent)
+	fmt.Fprintf(w, "Created\t%s\n", image.Created.Format("2006-01-02 15:04:05"))
+	fmt.Fprintf(w, "CreatedBy\t%s\n", strings.Join(image.ContainerConfig.Cmd, " "))
+	fmt.Fprintf(w, "Author\t%s\n", image.Author)
+	fmt.Fprintf(w, "Comment\t%s\n", image.Comment)
+	fmt.Fprintf(w, "DockerVersion\t%s\n", image.DockerVersion)
+	fmt.Fprintf(w, "Architecture\t%s\n", image.Architecture)
+
+	if image.Config != nil {
+		fmt.Fprintf(w, "Entrypoint\t%s\n", strings.Join(image.Config.Entrypoint, " "))
+		fmt.Fprintf(w, "Cmd\t%s\n", strings.Join(image.Config.Cmd, " "))
+		fmt.Fprintf(w, "Env\t%s\n", strings.Join(image.Config.Env, " "))
+	}
+
+	return nil
+}
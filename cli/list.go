@@ -1,11 +1,17 @@
 package cli
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"path"
+	"strings"
 	"text/tabwriter"
+	"text/template"
+	"time"
 
 	"github.com/dogestry/dogestry/remote"
+	"github.com/dogestry/dogestry/utils"
 )
 
 const ListHelpMessage string = `  List images on REMOTE.
@@ -13,12 +19,34 @@ const ListHelpMessage string = `  List images on REMOTE.
   Arguments:
     REMOTE       Name of REMOTE.
 
+  Options:
+    -long        Also show the image id, size and created time of each tag
+    -format      Print the tags as "json", or with a Go template, eg
+                 '{{.Repository}}:{{.Tag}} {{.ID}}'. Fields: Repository, Tag,
+                 ID, Size (bytes) and Created
+    -repo        Only list repositories starting with this prefix
+    -tag         Only list tags matching this glob, eg 'release-*'
+
   Examples:
     dogestry list s3://DockerBucket/Path/?region=us-east-1
-    dogestry list /path/to/images`
+    dogestry list -long -repo myapp /path/to/images
+    dogestry list -format json -tag 'release-*' /path/to/images`
+
+// A tag on the remote, as printed by list
+type listEntry struct {
+	Repository string
+	Tag        string
+	ID         string
+	Size       int64
+	Created    time.Time
+}
 
 func (cli *DogestryCli) CmdList(args ...string) error {
-	listFlags := cli.Subcmd("list", "REMOTE", ListHelpMessage)
+	listFlags := cli.Subcmd("list", "[OPTIONS] REMOTE", ListHelpMessage)
+	long := listFlags.Bool("long", false, "show image id, size and created time")
+	format := listFlags.String("format", "", "'json' or a Go template")
+	repoPrefix := listFlags.String("repo", "", "only list repositories starting with this prefix")
+	tagGlob := listFlags.String("tag", "", "only list tags matching this glob")
 	if err := listFlags.Parse(args); err != nil {
 		return nil
 	}
@@ -29,10 +57,21 @@ func (cli *DogestryCli) CmdList(args ...string) error {
 		os.Exit(2)
 	}
 
-	S3URL := listFlags.Arg(0)
+	if *tagGlob != "" {
+		if _, err := path.Match(*tagGlob, ""); err != nil {
+			return fmt.Errorf("invalid -tag pattern %q: %v", *tagGlob, err)
+		}
+	}
 
-	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
-	defer w.Flush()
+	var tmpl *template.Template
+	if *format != "" && *format != "json" {
+		var err error
+		if tmpl, err = template.New("list").Parse(*format); err != nil {
+			return fmt.Errorf("invalid -format template: %v", err)
+		}
+	}
+
+	S3URL := listFlags.Arg(0)
 
 	cli.Config.SetS3URL(S3URL)
 
@@ -46,12 +85,90 @@ func (cli *DogestryCli) CmdList(args ...string) error {
 		return err
 	}
 
-	fmt.Fprintf(w, "REPOSITORY\tTAG\n")
-
+	entries := make([]listEntry, 0, len(images))
 	for _, i := range images {
-		line := fmt.Sprintf("%s\t%s", i.Repository, i.Tag)
+		if !strings.HasPrefix(i.Repository, *repoPrefix) {
+			continue
+		}
+
+		if *tagGlob != "" {
+			if matched, _ := path.Match(*tagGlob, i.Tag); !matched {
+				continue
+			}
+		}
+
+		entry := listEntry{Repository: i.Repository, Tag: i.Tag}
+
+		// scripts get everything, details cost a few requests per tag otherwise
+		if *long || *format != "" {
+			if err := listDetails(r, &entry); err != nil {
+				return fmt.Errorf("%s:%s: %v", i.Repository, i.Tag, err)
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	switch {
+	case *format == "json":
+		return json.NewEncoder(os.Stdout).Encode(entries)
+
+	case tmpl != nil:
+		for _, entry := range entries {
+			if err := tmpl.Execute(os.Stdout, entry); err != nil {
+				return err
+			}
+			fmt.Println()
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	if *long {
+		fmt.Fprintf(w, "REPOSITORY\tTAG\tIMAGE ID\tSIZE\tCREATED\n")
+	} else {
+		fmt.Fprintf(w, "REPOSITORY\tTAG\n")
+	}
+
+	for _, entry := range entries {
+		line := fmt.Sprintf("%s\t%s", entry.Repository, entry.Tag)
+
+		if *long {
+			created := ""
+			if !entry.Created.IsZero() {
+				created = entry.Created.Format("2006-01-02 15:04:05")
+			}
+			line += fmt.Sprintf("\t%s\t%s\t%s", remote.ID(entry.ID).Short(), utils.HumanSize(entry.Size), created)
+		}
+
 		fmt.Fprintln(w, line)
 	}
 
 	return nil
 }
+
+// fill in the id, size and created time of a tag
+func listDetails(r remote.Remote, entry *listEntry) error {
+	id, err := r.ParseTag(entry.Repository, entry.Tag)
+	if err != nil || id == "" {
+		return err
+	}
+	entry.ID = id.String()
+
+	if entry.Size, err = remote.ImageSize(r, id); err != nil {
+		return err
+	}
+
+	image, err := r.ImageMetadata(id)
+	if err == remote.ErrNoSuchImage {
+		// dangling tag, nothing more to show
+		return nil
+	} else if err != nil {
+		return err
+	}
+	entry.Created = image.Created
+
+	return nil
+}
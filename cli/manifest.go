@@ -0,0 +1,331 @@
+package cli
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/dogestry/dogestry/remote"
+	"github.com/dogestry/dogestry/utils"
+)
+
+// An entry of manifest.json, written by `docker save` since Docker 1.10
+type manifestItem struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// The parts of a Docker 1.10+ tarball needed to check what was exported
+type savedImage struct {
+	manifest []manifestItem
+
+	// layer path in the tarball (eg "abc/layer.tar") -> diff id
+	layerDigests map[string]remote.ID
+}
+
+func newSavedImage() *savedImage {
+	return &savedImage{layerDigests: make(map[string]remote.ID)}
+}
+
+// Docker 1.10+ reports content addressable ids, prefixed with the hash function
+func isContentAddressable(id remote.ID) bool {
+	return strings.HasPrefix(string(id), "sha256:")
+}
+
+// Export an image saved in the Docker 1.10+ format.
+//
+// The config goes to images/<config digest>/config.json and every layer to
+// layers/<diff id>/layer.tar, so layers are shared between images. Layers
+// that already exist on the remote are not kept.
+func (cli *DogestryCli) exportV2ImageToFiles(image string, id remote.ID, r remote.Remote, root string) error {
+	layers, err := r.ImageLayers(id)
+	if err != nil {
+		return err
+	}
+
+	if len(layers) > 0 {
+		missing, err := missingLayers(r, layers)
+		if err != nil {
+			return err
+		}
+
+		if len(missing) == 0 {
+			fmt.Printf("  exists   : %v\n", id)
+			return nil
+		}
+	}
+
+	fmt.Printf("  not found: %v\n", id)
+	fmt.Printf("Exporting image: %v to: %v\n", image, root)
+
+	saved := newSavedImage()
+	if err := cli.readExport(image, saved.extract(root)); err != nil {
+		return err
+	}
+
+	layers, err = checkSavedImage(saved, id, root)
+	if err != nil {
+		return err
+	}
+
+	missing, err := missingLayers(r, layers)
+	if err != nil {
+		return err
+	}
+
+	for _, layer := range layers {
+		if _, ok := missing[layer]; ok {
+			fmt.Printf("  layer not found: %v\n", layer)
+		} else {
+			fmt.Printf("  layer exists   : %v\n", layer)
+			if err := os.RemoveAll(filepath.Join(root, "layers", layer.String())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Layers not yet on the remote
+func missingLayers(r remote.Remote, layers []remote.ID) (set, error) {
+	missing := make(set)
+
+	for _, layer := range layers {
+		exists, err := r.LayerExists(layer)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			missing[layer] = empty
+		}
+	}
+
+	return missing, nil
+}
+
+// Translate the files of a Docker 1.10+ tarball into the remote layout below
+// root, recording its manifest and layer digests.
+func (saved *savedImage) extract(root string) tarHandler {
+	return func(header *tar.Header, tarball io.Reader) error {
+		// only handle files (directories are implicit)
+		if header.Typeflag != tar.TypeReg {
+			return nil
+		}
+
+		name := strings.TrimPrefix(header.Name, "./")
+
+		switch {
+		case name == "manifest.json":
+			return json.NewDecoder(tarball).Decode(&saved.manifest)
+
+		case path.Dir(name) == "." && strings.HasSuffix(name, ".json"):
+			id := strings.TrimSuffix(name, ".json")
+			return writeFileFromTar(filepath.Join(root, "images", id, "config.json"), tarball)
+
+		case path.Base(name) == "layer.tar":
+			digest, err := writeLayerFromTar(filepath.Join(root, "layers"), tarball)
+			if err != nil {
+				return err
+			}
+			saved.layerDigests[name] = digest
+		}
+
+		// legacy json, VERSION and repositories files aren't needed
+		return nil
+	}
+}
+
+// Check the tarball contained the image we asked for and that every layer
+// matches the diff id recorded in the config. Returns the image's layers.
+func checkSavedImage(saved *savedImage, id remote.ID, root string) ([]remote.ID, error) {
+	configJson, err := ioutil.ReadFile(filepath.Join(root, "images", id.String(), "config.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	layers, layerPaths, err := manifestLayers(saved.manifest, id, configJson)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, layerPath := range layerPaths {
+		if saved.layerDigests[layerPath] != layers[i] {
+			return nil, fmt.Errorf("layer %s does not match diff id %s", layerPath, layers[i])
+		}
+	}
+
+	return layers, nil
+}
+
+// The layers of image id according to its config, and where manifest.json
+// says they are in the tarball.
+func manifestLayers(manifest []manifestItem, id remote.ID, configJson []byte) ([]remote.ID, []string, error) {
+	if len(manifest) != 1 {
+		return nil, nil, fmt.Errorf("expected one image in manifest.json, found %d", len(manifest))
+	}
+
+	item := manifest[0]
+	if strings.TrimSuffix(item.Config, ".json") != id.String() {
+		return nil, nil, fmt.Errorf("exported config %s does not match image %s", item.Config, id)
+	}
+
+	config, err := remote.ParseImageConfig(configJson)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	layers := config.Layers()
+	if len(layers) != len(item.Layers) {
+		return nil, nil, fmt.Errorf("config lists %d layers, manifest.json %d", len(layers), len(item.Layers))
+	}
+
+	return layers, item.Layers, nil
+}
+
+func writeFileFromTar(dest string, tarball io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(dest), os.ModeDir|0700); err != nil {
+		return err
+	}
+
+	destFile, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer destFile.Close()
+
+	_, err = io.Copy(destFile, tarball)
+	return err
+}
+
+// Write a layer to layersRoot/<diff id>/layer.tar, hashing it on the way.
+func writeLayerFromTar(layersRoot string, tarball io.Reader) (remote.ID, error) {
+	if err := os.MkdirAll(layersRoot, os.ModeDir|0700); err != nil {
+		return "", err
+	}
+
+	tmpFile, err := ioutil.TempFile(layersRoot, ".layer")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	hash := sha256.New()
+	wrote, err := io.Copy(io.MultiWriter(tmpFile, hash), tarball)
+	tmpFile.Close()
+	if err != nil {
+		return "", err
+	}
+
+	digest := remote.ID(hex.EncodeToString(hash.Sum(nil)))
+	fmt.Printf("  tar: layer %s extracted. Size: %s\n", digest.Short(), utils.HumanSize(wrote))
+
+	dest := filepath.Join(layersRoot, digest.String(), "layer.tar")
+	if err := os.MkdirAll(filepath.Dir(dest), os.ModeDir|0700); err != nil {
+		return "", err
+	}
+
+	return digest, os.Rename(tmpFile.Name(), dest)
+}
+
+// Move a downloaded Docker 1.10+ image into the layout `docker load` expects:
+// <config digest>.json next to <diff id>/layer.tar for each layer.
+// Legacy images are left alone.
+func (cli *DogestryCli) pullV2Layers(r remote.Remote, id remote.ID, imageRoot string) error {
+	layers, err := r.ImageLayers(id)
+	if err != nil || len(layers) == 0 {
+		return err
+	}
+
+	// an image can list the same layer more than once
+	names := make([]string, 0, len(layers))
+	seen := make(map[remote.ID]bool)
+	for _, layer := range layers {
+		if !seen[layer] {
+			seen[layer] = true
+			names = append(names, layer.String())
+		}
+	}
+
+	errMap := utils.Parallel(cli.Config.Concurrency, names, func(name string) error {
+		layer := remote.ID(name)
+		downloadPath := filepath.Join(imageRoot, layer.String())
+
+		fmt.Printf("Pulling layer '%s' to: %v\n", layer.Short(), downloadPath)
+
+		return r.PullLayer(layer, downloadPath)
+	})
+
+	if len(errMap) > 0 {
+		return errMap
+	}
+
+	return moveV2Config(id, imageRoot)
+}
+
+func moveV2Config(id remote.ID, imageRoot string) error {
+	downloadPath := filepath.Join(imageRoot, string(id))
+
+	err := os.Rename(filepath.Join(downloadPath, "config.json"), filepath.Join(imageRoot, id.String()+".json"))
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(downloadPath)
+}
+
+// Write manifest.json for loading a Docker 1.10+ image. Layers the docker
+// hosts already have aren't downloaded; docker load doesn't read them.
+func (cli *DogestryCli) createManifestJsonFile(image string, id remote.ID, layers []remote.ID, imageRoot string, r remote.Remote) error {
+	configPath := filepath.Join(imageRoot, id.String()+".json")
+
+	// nothing was downloaded, but docker load still needs the config to tag
+	if _, err := os.Stat(configPath); os.IsNotExist(err) {
+		if err := r.PullImageId(id, filepath.Join(imageRoot, string(id))); err != nil {
+			return err
+		}
+		if err := moveV2Config(id, imageRoot); err != nil {
+			return err
+		}
+	}
+
+	item, err := manifestFor(image, id, layers, r)
+	if err != nil {
+		return err
+	}
+
+	manifestFile, err := os.Create(filepath.Join(imageRoot, "manifest.json"))
+	if err != nil {
+		return err
+	}
+	defer manifestFile.Close()
+
+	return json.NewEncoder(manifestFile).Encode([]manifestItem{item})
+}
+
+// The manifest.json entry loading id, tagged as image if the tag exists
+func manifestFor(image string, id remote.ID, layers []remote.ID, r remote.Remote) (manifestItem, error) {
+	item := manifestItem{Config: id.String() + ".json"}
+
+	repoName, repoTag := remote.NormaliseImageName(image)
+	if tagId, err := r.ParseTag(repoName, repoTag); err != nil {
+		return item, err
+	} else if tagId != "" {
+		item.RepoTags = []string{repoName + ":" + repoTag}
+	}
+
+	for _, layer := range layers {
+		item.Layers = append(item.Layers, path.Join(layer.String(), "layer.tar"))
+	}
+
+	return item, nil
+}
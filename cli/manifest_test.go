@@ -0,0 +1,122 @@
+package cli
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dogestry/dogestry/remote"
+)
+
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// builds a tarball like the one `docker save` produces since Docker 1.10
+func makeV2Tarball(t *testing.T, configId string, config string, layers map[string]string, manifest string) *tar.Reader {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+
+	files := map[string]string{
+		configId + ".json": config,
+		"manifest.json":    manifest,
+		"repositories":     `{"myapp":{"latest":"legacyid"}}`,
+	}
+	for dir, content := range layers {
+		files[dir+"/layer.tar"] = content
+		files[dir+"/json"] = `{"id":"` + dir + `"}`
+		files[dir+"/VERSION"] = "1.0"
+	}
+
+	for name, content := range files {
+		header := &tar.Header{Name: name, Mode: 0600, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return tar.NewReader(buf)
+}
+
+func TestExtractV2Tarball(t *testing.T) {
+	root, err := ioutil.TempDir("", "dogestry-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	baseDigest := sha256Hex("base layer")
+	topDigest := sha256Hex("top layer")
+
+	config := fmt.Sprintf(`{"rootfs":{"type":"layers","diff_ids":["sha256:%s","sha256:%s"]}}`, baseDigest, topDigest)
+	configId := sha256Hex(config)
+	manifest := fmt.Sprintf(`[{"Config":"%s.json","RepoTags":["myapp:latest"],"Layers":["aaa/layer.tar","bbb/layer.tar"]}]`, configId)
+
+	tarball := makeV2Tarball(t, configId, config, map[string]string{"aaa": "base layer", "bbb": "top layer"}, manifest)
+
+	saved := newSavedImage()
+	if err := eachTarEntry(tarball, saved.extract(root)); err != nil {
+		t.Fatalf("Extracting tarball should work. Error: %v", err)
+	}
+
+	layers, err := checkSavedImage(saved, remote.ID("sha256:"+configId), root)
+	if err != nil {
+		t.Fatalf("Saved image should be consistent. Error: %v", err)
+	}
+
+	if len(layers) != 2 || layers[0] != remote.ID(baseDigest) || layers[1] != remote.ID(topDigest) {
+		t.Errorf("Unexpected layers: %v", layers)
+	}
+
+	expected := []string{
+		filepath.Join("images", configId, "config.json"),
+		filepath.Join("layers", baseDigest, "layer.tar"),
+		filepath.Join("layers", topDigest, "layer.tar"),
+	}
+	for _, file := range expected {
+		if _, err := os.Stat(filepath.Join(root, file)); err != nil {
+			t.Errorf("%s should have been extracted. Error: %v", file, err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "aaa")); err == nil {
+		t.Error("legacy layer dirs should not be extracted")
+	}
+}
+
+func TestCheckSavedImageLayerMismatch(t *testing.T) {
+	root, err := ioutil.TempDir("", "dogestry-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	config := fmt.Sprintf(`{"rootfs":{"type":"layers","diff_ids":["sha256:%s"]}}`, sha256Hex("expected layer"))
+	configId := sha256Hex(config)
+	manifest := fmt.Sprintf(`[{"Config":"%s.json","Layers":["aaa/layer.tar"]}]`, configId)
+
+	tarball := makeV2Tarball(t, configId, config, map[string]string{"aaa": "corrupt layer"}, manifest)
+
+	saved := newSavedImage()
+	if err := eachTarEntry(tarball, saved.extract(root)); err != nil {
+		t.Fatalf("Extracting tarball should work. Error: %v", err)
+	}
+
+	if _, err := checkSavedImage(saved, remote.ID("sha256:"+configId), root); err == nil {
+		t.Error("Layer not matching its diff id should be an error")
+	}
+}
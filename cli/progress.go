@@ -0,0 +1,194 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dogestry/dogestry/utils"
+)
+
+const (
+	barProgressInterval  = 500 * time.Millisecond
+	jsonProgressInterval = 5 * time.Second
+	progressBarWidth     = 30
+)
+
+// Progress of a docker host loading an image, printed as JSON when the
+// output isn't a terminal. Status is "loading", "done" or "failed".
+type LoadProgress struct {
+	Host    string
+	Status  string
+	Current int64
+	Total   int64
+}
+
+// Counts the bytes of the image a docker host has read
+type hostProgress struct {
+	host    string
+	total   int64
+	current int64
+
+	mu     sync.Mutex
+	status string
+}
+
+func newHostProgress(host string, total int64) *hostProgress {
+	return &hostProgress{host: host, total: total, status: "loading"}
+}
+
+func (p *hostProgress) add(n int) {
+	atomic.AddInt64(&p.current, int64(n))
+}
+
+func (p *hostProgress) setStatus(status string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status = status
+}
+
+func (p *hostProgress) snapshot() LoadProgress {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	current := atomic.LoadInt64(&p.current)
+
+	// the tarball's size is worked out ahead, don't overshoot it
+	if p.total > 0 && current > p.total {
+		current = p.total
+	}
+
+	return LoadProgress{p.host, p.status, current, p.total}
+}
+
+// Reports the progress of the hosts every interval until finished
+type progressReporter struct {
+	hosts    []*hostProgress
+	interval time.Duration
+	render   func(progress []LoadProgress)
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Bars on a terminal, JSON events otherwise and in server mode
+func (cli *DogestryCli) newProgressReporter(hosts []*hostProgress, out io.Writer, terminal bool) *progressReporter {
+	reporter := &progressReporter{
+		hosts: hosts,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+
+	if terminal && !cli.Config.ServerMode {
+		reporter.interval = barProgressInterval
+		reporter.render = newMultiBar(hosts, out).render
+	} else {
+		reporter.interval = jsonProgressInterval
+		reporter.render = jsonProgress(out)
+	}
+
+	return reporter
+}
+
+func (r *progressReporter) start() {
+	go func() {
+		defer close(r.done)
+
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				r.report()
+			case <-r.stop:
+				r.report()
+				return
+			}
+		}
+	}()
+}
+
+// report the final progress and stop
+func (r *progressReporter) finish() {
+	close(r.stop)
+	<-r.done
+}
+
+func (r *progressReporter) report() {
+	progress := make([]LoadProgress, len(r.hosts))
+	for i, host := range r.hosts {
+		progress[i] = host.snapshot()
+	}
+	r.render(progress)
+}
+
+func jsonProgress(out io.Writer) func(progress []LoadProgress) {
+	return func(progress []LoadProgress) {
+		for _, p := range progress {
+			if data, err := json.Marshal(p); err == nil {
+				fmt.Fprintln(out, string(data))
+			}
+		}
+	}
+}
+
+// A progress bar per host, redrawn in place
+type multiBar struct {
+	out       io.Writer
+	hostWidth int
+	drawn     int
+}
+
+func newMultiBar(hosts []*hostProgress, out io.Writer) *multiBar {
+	m := &multiBar{out: out}
+	for _, host := range hosts {
+		if len(host.host) > m.hostWidth {
+			m.hostWidth = len(host.host)
+		}
+	}
+	return m
+}
+
+func (m *multiBar) render(progress []LoadProgress) {
+	// back to the first bar
+	if m.drawn > 0 {
+		fmt.Fprintf(m.out, "\033[%dA", m.drawn)
+	}
+
+	for _, p := range progress {
+		fmt.Fprintf(m.out, "\r%s\033[K\n", m.line(p))
+	}
+
+	m.drawn = len(progress)
+}
+
+func (m *multiBar) line(p LoadProgress) string {
+	percent := 0
+	if p.Total > 0 {
+		percent = int(p.Current * 100 / p.Total)
+	}
+
+	filled := percent * progressBarWidth / 100
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+
+	return fmt.Sprintf("%-*s [%s] %3d%% %s / %s %s", m.hostWidth, p.Host, bar, percent,
+		utils.HumanSize(p.Current), utils.HumanSize(p.Total), p.Status)
+}
+
+// size of the tarball of files of the given sizes, as archive/tar writes it:
+// a header block per file, contents padded to blocks and two blocks at the end
+func tarSize(sizes []int64) int64 {
+	const block = 512
+
+	total := int64(2 * block)
+	for _, size := range sizes {
+		total += block + (size+block-1)/block*block
+	}
+
+	return total
+}
@@ -0,0 +1,94 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dogestry/dogestry/config"
+)
+
+func TestTarDirSize(t *testing.T) {
+	root, err := ioutil.TempDir("", "dogestry-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	if err := os.MkdirAll(filepath.Join(root, "abc"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"repositories":  `{"myapp":{"latest":"abc"}}`,
+		"abc/layer.tar": strings.Repeat("x", 1500),
+		"abc/VERSION":   "1.0",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(root, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	size, err := tarDirSize(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeTarDir(&buf, root); err != nil {
+		t.Fatal(err)
+	}
+
+	if size != int64(buf.Len()) {
+		t.Errorf("expected the size of the written tarball, %d, got %d", buf.Len(), size)
+	}
+}
+
+func TestMultiBarLine(t *testing.T) {
+	hosts := []*hostProgress{
+		newHostProgress("tcp://host-a:2375", 2048),
+		newHostProgress("tcp://b:2375", 2048),
+	}
+	hosts[0].add(1024)
+	hosts[1].add(4096)
+	hosts[1].setStatus("done")
+
+	m := newMultiBar(hosts, ioutil.Discard)
+
+	half := m.line(hosts[0].snapshot())
+	if !strings.HasPrefix(half, "tcp://host-a:2375 [") || !strings.Contains(half, " 50% ") || !strings.HasSuffix(half, " loading") {
+		t.Errorf("unexpected line for a half loaded host: %q", half)
+	}
+
+	// hosts are padded to line the bars up
+	done := m.line(hosts[1].snapshot())
+	if !strings.HasPrefix(done, "tcp://b:2375      [") || !strings.Contains(done, "100% ") || !strings.HasSuffix(done, " done") {
+		t.Errorf("unexpected line for a loaded host: %q", done)
+	}
+}
+
+func TestJSONProgress(t *testing.T) {
+	cli := &DogestryCli{Config: config.Config{ServerMode: true}}
+
+	host := newHostProgress("tcp://host-a:2375", 100)
+	host.add(40)
+
+	var buf bytes.Buffer
+	reporter := cli.newProgressReporter([]*hostProgress{host}, &buf, true)
+	reporter.start()
+	reporter.finish()
+
+	var progress LoadProgress
+	if err := json.Unmarshal(buf.Bytes(), &progress); err != nil {
+		t.Fatalf("server mode should report progress as JSON, got %q: %v", buf.String(), err)
+	}
+
+	expected := LoadProgress{Host: "tcp://host-a:2375", Status: "loading", Current: 40, Total: 100}
+	if progress != expected {
+		t.Errorf("expected %+v, got %+v", expected, progress)
+	}
+}
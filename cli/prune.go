@@ -0,0 +1,141 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/dogestry/dogestry/remote"
+)
+
+const PruneHelpMessage string = `  Remove tags from REMOTE according to a retention policy, then remove the
+  images only those tags referenced, the way gc does: images modified within
+  the grace period are kept, and tags are marked again right before removing
+  anything.
+
+  The policy is a JSON file with a list of rules. Each repository is handled
+  by the first rule whose "repositories" patterns match it (all repositories
+  if there are none). Tags matching a "protect" pattern are always kept and
+  don't count towards "keep_last".
+
+    {"rules": [
+      {"repositories": ["myapp", "team/*"], "keep_last": 10, "protect": ["latest", "release-*"]},
+      {"max_age": "30d", "protect": ["latest"]}
+    ]}
+
+  Arguments:
+    REMOTE       Name of REMOTE.
+
+  Options:
+    -policy      Path to the retention policy file
+    -grace       Keep images of pruned tags younger than this (default: 24h)
+    -dry-run     Print the keys that would be removed, without removing them
+
+  Examples:
+    dogestry prune -policy retention.json s3://DockerBucket/Path/?region=us-east-1
+    dogestry prune -policy retention.json -dry-run /path/to/images`
+
+func (cli *DogestryCli) CmdPrune(args ...string) error {
+	pruneFlags := cli.Subcmd("prune", "-policy FILE [OPTIONS] REMOTE", PruneHelpMessage)
+	policyFile := pruneFlags.String("policy", "", "path to the retention policy file")
+	grace := pruneFlags.Duration("grace", 24*time.Hour, "keep images of pruned tags younger than this")
+	dryRun := pruneFlags.Bool("dry-run", false, "only print the keys that would be removed")
+	if err := pruneFlags.Parse(args); err != nil {
+		return nil
+	}
+
+	if len(pruneFlags.Args()) < 1 {
+		fmt.Fprintln(cli.err, "Error: REMOTE not specified")
+		pruneFlags.Usage()
+		os.Exit(2)
+	}
+
+	if *policyFile == "" {
+		return errors.New("Error: -policy not specified")
+	}
+
+	policy, err := remote.LoadRetentionPolicy(*policyFile)
+	if err != nil {
+		return err
+	}
+
+	S3URL := pruneFlags.Arg(0)
+
+	cli.Config.SetS3URL(S3URL)
+
+	r, err := remote.NewRemote(cli.Config)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Remote: %v\n", r.Desc())
+
+	tags, err := remote.ListTags(r)
+	if err != nil {
+		return err
+	}
+
+	expired := policy.Expired(tags, time.Now())
+	if len(expired) == 0 {
+		fmt.Println("No tags to prune")
+		return nil
+	}
+
+	fmt.Printf("Pruning %d of %d tags:\n", len(expired), len(tags))
+
+	keys := make([]string, 0)
+	expiredImages := make([]remote.Image, 0, len(expired))
+	expiredIds := make([]remote.ID, 0, len(expired))
+
+	for _, tag := range expired {
+		fmt.Printf("  %s:%s (%s)\n", tag.Repository, tag.Tag, tag.LastModified.Format(time.RFC3339))
+
+		id, err := r.ParseTag(tag.Repository, tag.Tag)
+		if err != nil {
+			return err
+		}
+
+		keysForTag, err := tagKeys(r, tag.Repository, tag.Tag)
+		if err != nil {
+			return err
+		}
+
+		keys = append(keys, keysForTag...)
+		expiredImages = append(expiredImages, tag.Image)
+		expiredIds = append(expiredIds, id)
+	}
+
+	// take the cutoff before marking, anything pushed while we mark is kept
+	olderThan := time.Now().Add(-*grace)
+
+	fmt.Println("Finding images referenced by remaining tags...")
+	refs, err := remote.FindReferences(r, expiredImages...)
+	if err != nil {
+		return err
+	}
+
+	garbage := make([]remote.Garbage, 0)
+
+	for _, id := range expiredIds {
+		imageGarbage, err := remote.UnreferencedGarbage(r, id, refs)
+		if err != nil {
+			return err
+		}
+
+		garbage = append(garbage, imageGarbage...)
+
+		// several pruned tags can share images, only remove them once
+		if err := refs.Mark(r, id); err != nil {
+			return err
+		}
+	}
+
+	// the tags go first, so that marking again doesn't find them
+	if err := removeKeys(r, keys, *dryRun); err != nil {
+		return err
+	}
+
+	fmt.Println("Removing images only the pruned tags referenced...")
+	return sweep(r, garbage, olderThan, *dryRun)
+}
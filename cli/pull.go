@@ -8,6 +8,9 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/dogestry/dogestry/config"
@@ -21,12 +24,22 @@ const PullHelpMessage string = `  Pull IMAGE from REMOTE and load it into docker
     REMOTE       Name of REMOTE.
     IMAGE[:TAG]  Name of IMAGE. TAG is optional, and defaults to 'latest'.
 
+  Options:
+    -stream      Stream the image from REMOTE into docker without staging it
+                 on disk. The same stream is loaded into every pull host.
+    -min-success How many pull hosts must load the image for the pull to
+                 succeed, as a count or a percentage (default: all of them).
+
   Examples:
     dogestry -pullhosts tcp://host-1:2375 pull s3://DockerBucket/Path/ ubuntu:14.04
-    dogestry pull /path/to/images ubuntu`
+    dogestry pull /path/to/images ubuntu
+    dogestry pull -stream s3://DockerBucket/Path/ ubuntu:14.04
+    dogestry -pullhosts tcp://host-1:2375,tcp://host-2:2375,tcp://host-3:2375 pull -min-success 66% s3://DockerBucket/Path/ ubuntu`
 
 func (cli *DogestryCli) CmdPull(args ...string) error {
-	pullFlags := cli.Subcmd("pull", "REMOTE IMAGE[:TAG]", PullHelpMessage)
+	pullFlags := cli.Subcmd("pull", "[OPTIONS] REMOTE IMAGE[:TAG]", PullHelpMessage)
+	stream := pullFlags.Bool("stream", false, "stream the image into docker without staging it on disk")
+	minSuccess := pullFlags.String("min-success", "", "how many pull hosts must load the image, as a count or a percentage")
 
 	// Don't return error here, this part is only relevant for CLI
 	if err := pullFlags.Parse(args); err != nil {
@@ -42,6 +55,16 @@ func (cli *DogestryCli) CmdPull(args ...string) error {
 
 	cli.Config.SetS3URL(S3URL)
 
+	var err error
+	if cli.Config.MinSuccess, err = parseMinSuccess(*minSuccess, len(cli.PullHosts)); err != nil {
+		return err
+	}
+
+	pull := cli.RegularPull
+	if *stream {
+		pull = cli.StreamPull
+	}
+
 	// We are not a client, perform pull without any further host-related checks.
 	//
 	// Note: There is a possibility that a Docker host is not available but in
@@ -49,7 +72,7 @@ func (cli *DogestryCli) CmdPull(args ...string) error {
 	// perform host checks when running in server mode)
 	if cli.Config.ServerMode {
 		fmt.Printf("Handling new pull request for image: %v\n", image)
-		return cli.RegularPull(image)
+		return pull(image)
 	}
 
 	hosts := utils.ParseHosts(cli.PullHosts)
@@ -65,13 +88,25 @@ func (cli *DogestryCli) CmdPull(args ...string) error {
 	// Perform regular pull if we are explicitly told to _not_ use dogestry server(s)
 	if cli.Config.ForceLocal {
 		fmt.Println("Performing regular dogestry pull (dogestry server use disabled)...")
-		return cli.RegularPull(image)
+		return pull(image)
+	}
+
+	// Dogestry servers can only pull from S3, the local path may not exist there
+	if cli.Config.AWS.S3URL.Scheme != "s3" {
+		fmt.Println("Performing regular dogestry pull (remote is not on S3)...")
+		return pull(image)
+	}
+
+	// Dogestry servers use their own credentials, we need a token or a client certificate to use them
+	if cli.Config.ServerToken == "" && !cli.Config.LegacyAuth && !cli.Config.TLS.Enabled {
+		fmt.Println("Performing regular dogestry pull (no -server-token or -tls for dogestry servers)...")
+		return pull(image)
 	}
 
 	// Check if all hosts running Dogestry server
 	if err := cli.CheckHosts(hosts, checkTimeout, false); err != nil {
 		fmt.Println("Performing regular dogestry pull (one or more hosts is not running dogestry server)!")
-		return cli.RegularPull(image)
+		return pull(image)
 	} else {
 		fmt.Println("Detected dogestry server on all pullhosts!")
 		return cli.DogestryPull(hosts, image)
@@ -80,9 +115,11 @@ func (cli *DogestryCli) CmdPull(args ...string) error {
 
 func (cli *DogestryCli) CheckHosts(hosts map[string]int, timeout time.Duration, docker bool) error {
 	service := "Docker"
+	tlsConfig, err := dockerTLSConfig()
 
 	if !docker {
 		service = "Dogestry"
+		tlsConfig, err = cli.serverTLSConfig()
 
 		// Do not check for running dogestry server(s) if hosts are empty
 		if len(hosts) == 0 {
@@ -90,6 +127,10 @@ func (cli *DogestryCli) CheckHosts(hosts map[string]int, timeout time.Duration,
 		}
 	}
 
+	if err != nil {
+		return err
+	}
+
 	for host, port := range hosts {
 		remotePort := port
 
@@ -98,7 +139,7 @@ func (cli *DogestryCli) CheckHosts(hosts map[string]int, timeout time.Duration,
 			remotePort = cli.Config.ServerPort
 		}
 
-		if !utils.ServerCheck(host, remotePort, timeout, docker) {
+		if !utils.ServerCheck(host, remotePort, timeout, docker, tlsConfig) {
 			return fmt.Errorf("%v:%v does not appear to be running %v", host, port, service)
 		}
 	}
@@ -112,54 +153,82 @@ type HostErrTuple struct {
 }
 
 func (cli *DogestryCli) DogestryPull(hosts map[string]int, image string) error {
-	// Generate our auth header
-	authHeader, headerErr := cli.GenerateAuthHeader()
-	if headerErr != nil {
-		return headerErr
+	// Servers pull with their own credentials unless we're told to send ours
+	authHeader := ""
+	if cli.Config.LegacyAuth {
+		var headerErr error
+		if authHeader, headerErr = cli.GenerateAuthHeader(); headerErr != nil {
+			return headerErr
+		}
+	}
+
+	tlsConfig, err := cli.serverTLSConfig()
+	if err != nil {
+		return err
+	}
+
+	scheme := "http"
+	if tlsConfig != nil {
+		scheme = "https"
 	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
 
-	tupleChan := make(chan *HostErrTuple, 1)
+	// every goroutine sends its result, even when another host has failed
+	tupleChan := make(chan *HostErrTuple, len(hosts))
 
+	hostNames := make([]string, 0, len(hosts))
 	for host, _ := range hosts {
+		hostNames = append(hostNames, host)
+
 		fmt.Printf("Launching goroutine for pulling image on %v...\n", host)
 
-		fullURL := fmt.Sprintf("http://%v:%v/1.19/images/create?fromImage=%v", host,
-			cli.Config.ServerPort, url.QueryEscape(image))
+		fullURL := fmt.Sprintf("%v://%v:%v/1.19/images/create?fromImage=%v&remote=%v", scheme, host,
+			cli.Config.ServerPort, url.QueryEscape(image), url.QueryEscape(cli.Config.AWS.S3URL.String()))
 
 		// POST and evaluate JSON stream updates
-		go cli.PerformDogestryPull(fullURL, host, authHeader, tupleChan)
+		go cli.PerformDogestryPull(client, fullURL, host, authHeader, tupleChan)
 	}
+	sort.Strings(hostNames)
 
-	errorMessage := ""
-	finished := make([]string, 0)
-
-	// Listen for updates from all goroutines
-	for hostStatus := range tupleChan {
+	// Wait for all goroutines to finish
+	errMap := make(map[string]error)
+	for range hosts {
+		hostStatus := <-tupleChan
 		if hostStatus.Err != nil {
-			// Bail if we run into an error on any host
-			errorMessage = fmt.Sprintf("%v: %v; ", hostStatus.Server, hostStatus.Err.Error())
-			break
-		} else {
-			// Received update, no error == goroutine has finished
-			finished = append(finished, hostStatus.Server)
+			errMap[hostStatus.Server] = hostStatus.Err
 		}
+	}
 
-		// All goroutines have finished
-		if len(finished) == len(hosts) {
-			break
-		}
+	return cli.outputStatus(hostNames, errMap)
+}
+
+// parseMinSuccess converts a -min-success value, a count of hosts like "3" or
+// a percentage of them like "75%", to a count. An empty value means all hosts.
+func parseMinSuccess(value string, hosts int) (int, error) {
+	if value == "" {
+		return 0, nil
 	}
 
-	close(tupleChan)
+	isPercent := strings.HasSuffix(value, "%")
 
-	if errorMessage != "" {
-		return fmt.Errorf("Ran into one or more errors: %v", errorMessage)
+	n, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+	if err != nil || n < 1 || (isPercent && n > 100) {
+		return 0, fmt.Errorf("Invalid -min-success '%s': expected a count of hosts or a percentage", value)
 	}
 
-	return nil
+	if isPercent {
+		// round up, 50% of 3 hosts is 2
+		return (n*hosts + 99) / 100, nil
+	}
+
+	if n > hosts {
+		return 0, fmt.Errorf("Invalid -min-success '%s': there are only %d pull hosts", value, hosts)
+	}
+
+	return n, nil
 }
 
-func (cli *DogestryCli) PerformDogestryPull(fullURL, host, authHeader string, tupleChan chan *HostErrTuple) {
+func (cli *DogestryCli) PerformDogestryPull(client *http.Client, fullURL, host, authHeader string, tupleChan chan *HostErrTuple) {
 	// Request dogestry server to pull image
 	req, requestErr := http.NewRequest("POST", fullURL, nil)
 	if requestErr != nil {
@@ -170,11 +239,14 @@ func (cli *DogestryCli) PerformDogestryPull(fullURL, host, authHeader string, tu
 		return
 	}
 
-	req.Header.Set("X-Registry-Auth", authHeader)
+	if authHeader != "" {
+		req.Header.Set("X-Registry-Auth", authHeader)
+	}
+	if cli.Config.ServerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cli.Config.ServerToken)
+	}
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-
 	resp, httpErr := client.Do(req)
 	if httpErr != nil {
 		tupleChan <- &HostErrTuple{
@@ -197,16 +269,16 @@ func (cli *DogestryCli) StreamUpdates(host string, body io.ReadCloser, tupleChan
 	for {
 		var statusUpdate map[string]interface{}
 
+		// the stream ends with "Done", anything else means the pull failed
 		if err := d.Decode(&statusUpdate); err != nil {
-			// Not sure if we ever hit this state; keeping just in case.
-			if err == io.EOF {
-				fmt.Printf("Hmmm - reached EOF for host %v\n", host)
-				break
-			} else if err == io.ErrUnexpectedEOF {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				fmt.Printf("[ERROR] %v: stream ended before the pull was done\n", host)
+				serverError = fmt.Errorf("Server disappeared before the pull was done: %v", err)
+			} else {
 				fmt.Printf("[ERROR] %v: %v\n", host, err)
-				serverError = fmt.Errorf("Server disappeared: %v", err)
-				break
+				serverError = fmt.Errorf("Bad status update from host %v: %v", host, err)
 			}
+			break
 		}
 
 		if _, ok := statusUpdate["error"]; ok {
@@ -283,11 +355,24 @@ func (cli *DogestryCli) RegularPull(image string) error {
 		return err
 	}
 
-	fmt.Println("Generating repositories JSON file...")
-	if err := cli.createRepositoriesJsonFile(image, imageRoot, r); err != nil {
+	layers, err := r.ImageLayers(id)
+	if err != nil {
 		return err
 	}
 
+	// Docker 1.10+ images are loaded with a manifest instead
+	if len(layers) > 0 {
+		fmt.Println("Generating manifest JSON file...")
+		if err := cli.createManifestJsonFile(image, id, layers, imageRoot, r); err != nil {
+			return err
+		}
+	} else {
+		fmt.Println("Generating repositories JSON file...")
+		if err := cli.createRepositoriesJsonFile(image, imageRoot, r); err != nil {
+			return err
+		}
+	}
+
 	fmt.Printf("Importing image(%s) TAR file to docker hosts: %v\n", id.Short(), cli.PullHosts)
 	if err := cli.sendTar(imageRoot); err != nil {
 		return err
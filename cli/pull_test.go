@@ -0,0 +1,28 @@
+package cli
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestStreamUpdates(t *testing.T) {
+	cli := &DogestryCli{}
+
+	streams := map[string]bool{
+		`{"status":"Pulling"}{"status":"Done"}`:         true,
+		`{"status":"Pulling"}`:                          false,
+		`{"status":"Pulling"}{"status":"Do`:             false,
+		`{"status":"Pulling"}not json`:                  false,
+		`{"status":"Pulling"}{"error":"no such image"}`: false,
+	}
+
+	for stream, ok := range streams {
+		tuples := make(chan *HostErrTuple, 1)
+		cli.StreamUpdates("host", ioutil.NopCloser(strings.NewReader(stream)), tuples)
+
+		if tuple := <-tuples; (tuple.Err == nil) != ok {
+			t.Errorf("%s: expected success %v, got %v", stream, ok, tuple.Err)
+		}
+	}
+}
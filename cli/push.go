@@ -2,11 +2,13 @@ package cli
 
 import (
 	"archive/tar"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
@@ -21,12 +23,19 @@ const PushHelpMessage string = `  Push IMAGE from docker to REMOTE.
     REMOTE       Name of REMOTE.
     IMAGE[:TAG]  Name of IMAGE. TAG is optional, and defaults to 'latest'.
 
+  Options:
+    -stream      Upload the files of IMAGE as docker exports them, without
+                 staging them on disk. Only S3 remotes can be streamed to,
+                 other remotes are pushed from a temp dir as usual.
+
   Examples:
     dogestry push s3://DockerBucket/Path/?region=us-east-1 ubuntu:14.04
-    dogestry push /path/to/images ubuntu`
+    dogestry push /path/to/images ubuntu
+    dogestry push -stream s3://DockerBucket/Path/ ubuntu:14.04`
 
 func (cli *DogestryCli) CmdPush(args ...string) error {
-	pushFlags := cli.Subcmd("push", "REMOTE IMAGE[:TAG]", PushHelpMessage)
+	pushFlags := cli.Subcmd("push", "[OPTIONS] REMOTE IMAGE[:TAG]", PushHelpMessage)
+	stream := pushFlags.Bool("stream", false, "upload the image as docker exports it, without staging it on disk")
 	if err := pushFlags.Parse(args); err != nil {
 		return nil
 	}
@@ -40,26 +49,26 @@ func (cli *DogestryCli) CmdPush(args ...string) error {
 	S3URL := pushFlags.Arg(0)
 	image := pushFlags.Arg(1)
 
-	imageRoot, err := cli.WorkDir(image)
-	if err != nil {
-		return err
-	}
-
 	cli.Config.SetS3URL(S3URL)
 
-	remote, err := remote.NewRemote(cli.Config)
+	r, err := remote.NewRemote(cli.Config)
 	if err != nil {
 		return err
 	}
 
 	fmt.Printf("Using docker endpoint for push: %v\n", cli.DockerHost)
-	fmt.Printf("Remote: %v\n", remote.Desc())
+	fmt.Printf("Remote: %v\n", r.Desc())
 
-	if err = cli.exportToFiles(image, remote, imageRoot); err != nil {
-		return err
+	if s, ok := r.(remote.StreamingRemote); ok && *stream {
+		err = cli.streamPush(image, s)
+	} else {
+		if *stream {
+			fmt.Println("Remote can't be streamed to, pushing from a temp dir")
+		}
+		err = cli.pushFromFiles(image, r)
 	}
 
-	if err := remote.Push(image, imageRoot); err != nil {
+	if err != nil {
 		fmt.Printf(`{"Status":"error", "Message": "%v"}`+"\n", err.Error())
 		return err
 	}
@@ -68,6 +77,20 @@ func (cli *DogestryCli) CmdPush(args ...string) error {
 	return nil
 }
 
+// Export the missing files of image to a temp dir, then push the dir
+func (cli *DogestryCli) pushFromFiles(image string, r remote.Remote) error {
+	imageRoot, err := cli.WorkDir(image)
+	if err != nil {
+		return err
+	}
+
+	if err = cli.exportToFiles(image, r, imageRoot); err != nil {
+		return err
+	}
+
+	return r.Push(image, imageRoot)
+}
+
 // There's no Set data structure in Go, so use a map to simulate one.
 type set map[remote.ID]struct{}
 
@@ -79,59 +102,64 @@ var empty struct{}
 func (cli *DogestryCli) exportImageToFiles(image, root string, saveIds set) error {
 	fmt.Printf("Exporting image: %v to: %v\n", image, root)
 
-	reader, writer := io.Pipe()
-	defer writer.Close()
-	defer reader.Close()
-
-	tarball := tar.NewReader(reader)
+	return cli.readExport(image, func(header *tar.Header, tarball io.Reader) error {
+		parts := strings.Split(header.Name, "/")
+		idFromFile := remote.ID(parts[0])
 
-	errch := make(chan error)
-
-	go func() {
-		defer close(errch)
-		for {
-			header, err := tarball.Next()
+		if _, ok := saveIds[idFromFile]; !ok {
+			return nil
+		}
 
-			if err == io.EOF {
-				break
-			}
+		return cli.createFileFromTar(root, header, tarball)
+	})
+}
 
-			if err != nil {
-				errch <- err
-				return
-			}
+// Called for each file of a tarball, with a reader of its contents
+type tarHandler func(header *tar.Header, tarball io.Reader) error
 
-			parts := strings.Split(header.Name, "/")
-			idFromFile := remote.ID(parts[0])
+// readExport calls handle for each file of the tarball `docker save` exports
+// for image, as it's read.
+func (cli *DogestryCli) readExport(image string, handle tarHandler) error {
+	reader, writer := io.Pipe()
+	defer reader.Close()
 
-			if _, ok := saveIds[idFromFile]; ok {
-				if err := cli.createFileFromTar(root, header, tarball); err != nil {
-					errch <- err
-					return
-				}
-			} else {
-				// Drain the reader. Is this necessary?
-				if _, err := io.Copy(ioutil.Discard, tarball); err != nil {
-					errch <- err
-					return
-				}
+	errch := make(chan error, 1)
 
-			}
+	go func() {
+		err := eachTarEntry(tar.NewReader(reader), handle)
+		if err != nil {
+			// unblocks ExportImage
+			reader.CloseWithError(err)
 		}
 
-		errch <- nil
+		io.Copy(ioutil.Discard, reader)
+		errch <- err
 	}()
 
-	if err := cli.Client.ExportImage(docker.ExportImageOptions{image, writer}); err != nil {
-		return err
-	}
+	exportErr := cli.Client.ExportImage(docker.ExportImageOptions{Name: image, OutputStream: writer})
+	writer.CloseWithError(exportErr)
 
 	// wait for the tar reader
 	if err := <-errch; err != nil {
 		return err
 	}
 
-	return nil
+	return exportErr
+}
+
+func eachTarEntry(tarball *tar.Reader, handle tarHandler) error {
+	for {
+		header, err := tarball.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := handle(header, tarball); err != nil {
+			return err
+		}
+	}
 }
 
 func (cli *DogestryCli) createFileFromTar(root string, header *tar.Header, tarball io.Reader) error {
@@ -224,15 +252,39 @@ func (cli *DogestryCli) exportToFiles(image string, r remote.Remote, imageRoot s
 	imageID := remote.ID(imageHistory[0].ID)
 	repoName, repoTag := remote.NormaliseImageName(image)
 
+	// Docker 1.10+ saves images in a different format, without the parent chain
+	if isContentAddressable(imageID) {
+		if err := cli.exportV2ImageToFiles(image, imageID, r, imageRoot); err != nil {
+			return err
+		}
+
+		return cli.exportMetaDataToFiles(repoName, repoTag, remote.ID(imageID.String()), imageRoot)
+	}
+
 	// Check the remote to see what layers are missing. Only missing Ids will
 	// need to be saved to disk when exporting the docker image.
+	missingIds := missingImageIds(imageHistory, r)
+
+	if len(missingIds) > 0 {
+		if err := cli.exportImageToFiles(image, imageRoot, missingIds); err != nil {
+			return err
+		}
+	}
+
+	if err := cli.exportMetaDataToFiles(repoName, repoTag, imageID, imageRoot); err != nil {
+		return err
+	}
 
+	return nil
+}
+
+// The images of a legacy image's history that aren't on the remote
+func missingImageIds(imageHistory []docker.ImageHistory, r remote.Remote) set {
 	missingIds := make(set)
 
 	for _, i := range imageHistory {
 		id := remote.ID(i.ID)
-		_, err = r.ImageMetadata(id)
-		if err == nil {
+		if _, err := r.ImageMetadata(id); err == nil {
 			fmt.Printf("  exists   : %v\n", id)
 		} else {
 			fmt.Printf("  not found: %v\n", id)
@@ -240,15 +292,176 @@ func (cli *DogestryCli) exportToFiles(image string, r remote.Remote, imageRoot s
 		}
 	}
 
-	if len(missingIds) > 0 {
-		if err := cli.exportImageToFiles(image, imageRoot, missingIds); err != nil {
+	return missingIds
+}
+
+// streamPush uploads the files of image missing from the remote as docker
+// exports them, without writing them to disk. The tag is written last, once
+// the image is complete.
+func (cli *DogestryCli) streamPush(image string, s remote.StreamingRemote) error {
+	imageHistory, err := cli.Client.ImageHistory(image)
+	if err != nil {
+		fmt.Printf("Error getting image history: %v\n", err)
+		return err
+	}
+
+	fmt.Println("Checking layers on remote")
+
+	imageID := remote.ID(imageHistory[0].ID)
+	repoName, repoTag := remote.NormaliseImageName(image)
+
+	if isContentAddressable(imageID) {
+		if err := cli.streamV2Image(image, imageID, s); err != nil {
+			return err
+		}
+		imageID = remote.ID(imageID.String())
+	} else if missingIds := missingImageIds(imageHistory, s); len(missingIds) > 0 {
+		fmt.Printf("Streaming image: %v to: %v\n", image, s.Desc())
+		if err := cli.readExport(image, streamImageFiles(s, missingIds)); err != nil {
 			return err
 		}
 	}
 
-	if err := cli.exportMetaDataToFiles(repoName, repoTag, imageID, imageRoot); err != nil {
+	fmt.Printf("Tagging %s:%s as %s\n", repoName, repoTag, imageID.Short())
+	return s.PushStream(remote.TagKey(repoName, repoTag), strings.NewReader(string(imageID)), int64(len(imageID)), "")
+}
+
+// Uploads the files of the legacy images in ids
+func streamImageFiles(s remote.StreamingRemote, ids set) tarHandler {
+	return func(header *tar.Header, tarball io.Reader) error {
+		if header.Typeflag != tar.TypeReg {
+			return nil
+		}
+
+		name := strings.TrimPrefix(header.Name, "./")
+		if _, ok := ids[remote.ID(path.Dir(name))]; !ok {
+			return nil
+		}
+
+		key := path.Join("images", name)
+		fmt.Printf("  tar: streaming file: %s (%s)\n", key, utils.HumanSize(header.Size))
+
+		return s.PushStream(key, tarball, header.Size, "")
+	}
+}
+
+// Stream a Docker 1.10+ image. Layers are stored by diff id, which only the
+// config and manifest.json tell, and those come last in the export. So the
+// export is read twice: for them, then for the layers missing on the remote.
+// The config is uploaded last, once the layers are complete.
+func (cli *DogestryCli) streamV2Image(image string, id remote.ID, s remote.StreamingRemote) error {
+	layers, err := s.ImageLayers(id)
+	if err != nil {
 		return err
 	}
 
-	return nil
+	if len(layers) > 0 {
+		missing, err := missingLayers(s, layers)
+		if err != nil {
+			return err
+		}
+
+		if len(missing) == 0 {
+			fmt.Printf("  exists   : %v\n", id)
+			return nil
+		}
+	}
+
+	fmt.Printf("  not found: %v\n", id)
+	fmt.Printf("Reading manifest of image: %v\n", image)
+
+	exported := &exportedManifest{id: id}
+	if err := cli.readExport(image, exported.read); err != nil {
+		return err
+	}
+
+	layers, layerPaths, err := manifestLayers(exported.manifest, id, exported.config)
+	if err != nil {
+		return err
+	}
+
+	wanted, err := wantedLayers(s, layers, layerPaths)
+	if err != nil {
+		return err
+	}
+
+	if len(wanted) > 0 {
+		fmt.Printf("Streaming layers of image: %v to: %v\n", image, s.Desc())
+		if err := cli.readExport(image, streamLayers(s, wanted)); err != nil {
+			return err
+		}
+
+		if len(wanted) > 0 {
+			return fmt.Errorf("%d layers are missing from the export of %s", len(wanted), image)
+		}
+	}
+
+	configKey := path.Join(remote.ImagePrefix(id), "config.json")
+	return s.PushStream(configKey, bytes.NewReader(exported.config), int64(len(exported.config)), id.String())
+}
+
+// manifest.json and the config of a Docker 1.10+ image, read from its export
+type exportedManifest struct {
+	id       remote.ID
+	manifest []manifestItem
+	config   []byte
+}
+
+func (e *exportedManifest) read(header *tar.Header, tarball io.Reader) error {
+	var err error
+
+	switch strings.TrimPrefix(header.Name, "./") {
+	case "manifest.json":
+		err = json.NewDecoder(tarball).Decode(&e.manifest)
+	case e.id.String() + ".json":
+		e.config, err = ioutil.ReadAll(tarball)
+	}
+
+	return err
+}
+
+// The layers missing on the remote, keyed by their path in the export. A
+// layer listed more than once is only uploaded once.
+func wantedLayers(r remote.Remote, layers []remote.ID, layerPaths []string) (map[string]remote.ID, error) {
+	missing, err := missingLayers(r, layers)
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := make(map[string]remote.ID)
+	for i, layer := range layers {
+		if _, ok := missing[layer]; !ok {
+			fmt.Printf("  layer exists   : %v\n", layer)
+			continue
+		}
+
+		fmt.Printf("  layer not found: %v\n", layer)
+		wanted[layerPaths[i]] = layer
+		delete(missing, layer)
+	}
+
+	return wanted, nil
+}
+
+// Uploads the layers in wanted to layers/<diff id>/layer.tar, checking them
+// against their diff id. Uploaded layers are removed from wanted.
+func streamLayers(s remote.StreamingRemote, wanted map[string]remote.ID) tarHandler {
+	return func(header *tar.Header, tarball io.Reader) error {
+		layerPath := strings.TrimPrefix(header.Name, "./")
+
+		layer, ok := wanted[layerPath]
+		if !ok || header.Typeflag != tar.TypeReg {
+			return nil
+		}
+
+		fmt.Printf("  tar: streaming layer %s (%s)\n", layer.Short(), utils.HumanSize(header.Size))
+
+		key := path.Join(remote.LayerPrefix(layer), "layer.tar")
+		if err := s.PushStream(key, tarball, header.Size, layer.String()); err != nil {
+			return err
+		}
+
+		delete(wanted, layerPath)
+		return nil
+	}
 }
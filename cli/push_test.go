@@ -0,0 +1,126 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dogestry/dogestry/remote"
+)
+
+// a remote that keeps what's streamed to it in memory
+type memoryStreamingRemote struct {
+	remote.Remote
+	files map[string]string
+}
+
+func (m *memoryStreamingRemote) PushStream(key string, reader io.Reader, size int64, sum string) error {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	if int64(len(data)) != size {
+		return fmt.Errorf("%s: expected %d bytes, read %d", key, size, len(data))
+	}
+
+	if sum != "" && sum != sha256Hex(string(data)) {
+		return remote.ErrDigestMismatch
+	}
+
+	m.files[key] = string(data)
+	return nil
+}
+
+func TestStreamImageFiles(t *testing.T) {
+	s := &memoryStreamingRemote{files: make(map[string]string)}
+
+	tarball := makeV2Tarball(t, "cfg", "{}", map[string]string{"aaa": "base layer", "bbb": "top layer"}, "[]")
+
+	if err := eachTarEntry(tarball, streamImageFiles(s, set{"bbb": empty})); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"images/bbb/json":      `{"id":"bbb"}`,
+		"images/bbb/layer.tar": "top layer",
+		"images/bbb/VERSION":   "1.0",
+	}
+
+	if len(s.files) != len(expected) {
+		t.Fatalf("only the missing image should be streamed, got %v", s.files)
+	}
+	for key, content := range expected {
+		if s.files[key] != content {
+			t.Errorf("%s should be %q, got %q", key, content, s.files[key])
+		}
+	}
+}
+
+func TestStreamV2Layers(t *testing.T) {
+	baseDigest := sha256Hex("base layer")
+	topDigest := sha256Hex("top layer")
+
+	config := fmt.Sprintf(`{"rootfs":{"type":"layers","diff_ids":["sha256:%s","sha256:%s"]}}`, baseDigest, topDigest)
+	configId := sha256Hex(config)
+	manifest := fmt.Sprintf(`[{"Config":"%s.json","RepoTags":["myapp:latest"],"Layers":["aaa/layer.tar","bbb/layer.tar"]}]`, configId)
+
+	// the base layer was pushed before
+	r, remoteDir := makeLocalRemote(t, map[string]string{
+		"layers/" + baseDigest + "/layer.tar": "base layer",
+	})
+	defer os.RemoveAll(remoteDir)
+
+	s := &memoryStreamingRemote{Remote: r, files: make(map[string]string)}
+	id := remote.ID("sha256:" + configId)
+
+	exported := &exportedManifest{id: id}
+	tarball := makeV2Tarball(t, configId, config, map[string]string{"aaa": "base layer", "bbb": "top layer"}, manifest)
+	if err := eachTarEntry(tarball, exported.read); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(exported.config) != config {
+		t.Fatalf("the config should be read from the export, got %q", exported.config)
+	}
+
+	layers, layerPaths, err := manifestLayers(exported.manifest, id, exported.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wanted, err := wantedLayers(s, layers, layerPaths)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(wanted) != 1 || wanted["bbb/layer.tar"] != remote.ID(topDigest) {
+		t.Fatalf("only the top layer should be wanted, got %v", wanted)
+	}
+
+	tarball = makeV2Tarball(t, configId, config, map[string]string{"aaa": "base layer", "bbb": "top layer"}, manifest)
+	if err := eachTarEntry(tarball, streamLayers(s, wanted)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(wanted) != 0 {
+		t.Errorf("streamed layers should no longer be wanted, got %v", wanted)
+	}
+
+	if len(s.files) != 1 || s.files["layers/"+topDigest+"/layer.tar"] != "top layer" {
+		t.Errorf("the top layer should be streamed to its diff id, got %v", s.files)
+	}
+}
+
+func TestStreamV2LayersDigestMismatch(t *testing.T) {
+	s := &memoryStreamingRemote{files: make(map[string]string)}
+	wanted := map[string]remote.ID{"aaa/layer.tar": remote.ID(sha256Hex("expected layer"))}
+
+	tarball := makeV2Tarball(t, "cfg", "{}", map[string]string{"aaa": "corrupt layer"}, "[]")
+
+	if err := eachTarEntry(tarball, streamLayers(s, wanted)); err != remote.ErrDigestMismatch {
+		t.Errorf("a layer not matching its diff id should fail the push. Error: %v", err)
+	}
+}
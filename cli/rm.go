@@ -0,0 +1,141 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dogestry/dogestry/remote"
+)
+
+const RmHelpMessage string = `  Remove IMAGE[:TAG] from REMOTE.
+
+  Only the tag is removed, unless -prune is given. Pruned images are
+  removed like gc removes them: images modified within the grace period are
+  kept, and tags are marked again right before removing anything.
+
+  Arguments:
+    REMOTE       Name of REMOTE.
+    IMAGE[:TAG]  Name of IMAGE. TAG is optional, and defaults to 'latest'.
+
+  Options:
+    -prune       Also remove the images that no other tag on REMOTE references
+    -grace       Keep pruned images younger than this (default: 24h)
+    -dry-run     Print the keys that would be removed, without removing them
+
+  Examples:
+    dogestry rm s3://DockerBucket/Path/?region=us-east-1 ubuntu:14.04
+    dogestry rm -prune -dry-run /path/to/images ubuntu`
+
+func (cli *DogestryCli) CmdRm(args ...string) error {
+	rmFlags := cli.Subcmd("rm", "[OPTIONS] REMOTE IMAGE[:TAG]", RmHelpMessage)
+	prune := rmFlags.Bool("prune", false, "also remove unreferenced images")
+	grace := rmFlags.Duration("grace", 24*time.Hour, "keep pruned images younger than this")
+	dryRun := rmFlags.Bool("dry-run", false, "only print the keys that would be removed")
+	if err := rmFlags.Parse(args); err != nil {
+		return nil
+	}
+
+	if len(rmFlags.Args()) < 2 {
+		fmt.Fprintln(cli.err, "Error: REMOTE and IMAGE not specified")
+		rmFlags.Usage()
+		os.Exit(2)
+	}
+
+	S3URL := rmFlags.Arg(0)
+	image := rmFlags.Arg(1)
+
+	cli.Config.SetS3URL(S3URL)
+
+	r, err := remote.NewRemote(cli.Config)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Remote: %v\n", r.Desc())
+
+	repoName, repoTag := remote.NormaliseImageName(image)
+
+	id, err := r.ParseTag(repoName, repoTag)
+	if err != nil {
+		return err
+	} else if id == "" {
+		return fmt.Errorf("%v: %s:%s", remote.ErrNoSuchTag, repoName, repoTag)
+	}
+
+	keys, err := tagKeys(r, repoName, repoTag)
+	if err != nil {
+		return err
+	}
+
+	if !*prune {
+		return removeKeys(r, keys, *dryRun)
+	}
+
+	// take the cutoff before marking, anything pushed while we mark is kept
+	olderThan := time.Now().Add(-*grace)
+
+	fmt.Println("Finding images referenced by other tags...")
+	refs, err := remote.FindReferences(r, remote.Image{Repository: repoName, Tag: repoTag})
+	if err != nil {
+		return err
+	}
+
+	garbage, err := remote.UnreferencedGarbage(r, id, refs)
+	if err != nil {
+		return err
+	}
+
+	// the tag goes first, so that marking again doesn't find it
+	if err := removeKeys(r, keys, *dryRun); err != nil {
+		return err
+	}
+
+	fmt.Println("Pruning images only the tag referenced...")
+	return sweep(r, garbage, olderThan, *dryRun)
+}
+
+// The tag file and its sum, if any
+func tagKeys(r remote.Remote, repoName, repoTag string) ([]string, error) {
+	tagKey := remote.TagKey(repoName, repoTag)
+
+	keyInfos, err := r.ListKeys(tagKey)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0)
+	for _, keyInfo := range keyInfos {
+		if keyInfo.Key == tagKey || keyInfo.Key == tagKey+".sum" {
+			keys = append(keys, keyInfo.Key)
+		}
+	}
+
+	return keys, nil
+}
+
+func removeKeys(r remote.Remote, keys []string, dryRun bool) error {
+	if len(keys) == 0 {
+		fmt.Println("Nothing to remove")
+		return nil
+	}
+
+	if dryRun {
+		fmt.Println("Would remove:")
+	} else {
+		fmt.Println("Removing:")
+	}
+	fmt.Printf("  %s\n", strings.Join(keys, "\n  "))
+
+	if dryRun {
+		return nil
+	}
+
+	if err := r.RemoveKeys(keys); err != nil {
+		return err
+	}
+
+	fmt.Printf("Removed %d keys\n", len(keys))
+	return nil
+}
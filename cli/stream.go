@@ -0,0 +1,553 @@
+package cli
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dogestry/dogestry/remote"
+	"github.com/dogestry/dogestry/utils"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// A file of the tarball loaded into docker, either read from a key on the
+// remote or generated (manifest.json, repositories).
+type tarEntry struct {
+	name string
+	key  string
+	size int64
+	data []byte
+
+	// the key has a sha256 digest to check it against
+	hasSum bool
+}
+
+// StreamPull loads image into the docker hosts straight from the remote.
+//
+// Nothing is staged on disk: the tarball `docker load` reads is written as the
+// files are downloaded, and the same stream goes to every pull host.
+func (cli *DogestryCli) StreamPull(image string) error {
+	r, err := remote.NewRemote(cli.Config)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Using docker endpoints for pull: %v\n", cli.PullHosts)
+	fmt.Printf("S3 Connection: %v\n", r.Desc())
+
+	fmt.Printf("Image tag: %v\n", image)
+
+	id, err := r.ResolveImageNameToId(image)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Image '%s' resolved to ID '%s'\n", image, id.Short())
+
+	fmt.Println("Determining which images need to be streamed from S3...")
+	downloadMap, err := cli.makeDownloadMap(r, id, "")
+	if err != nil {
+		return err
+	}
+
+	entries, err := streamEntries(r, image, id, downloadMap)
+	if err != nil {
+		return err
+	}
+
+	sizes := make([]int64, len(entries))
+	for i, entry := range entries {
+		sizes[i] = entry.size + int64(len(entry.data))
+	}
+
+	fmt.Printf("Streaming image(%s) to docker hosts: %v\n", id.Short(), cli.PullHosts)
+	return cli.loadTar(tarSize(sizes), func(w io.Writer) error {
+		return writeTarEntries(w, r, entries)
+	})
+}
+
+// The files to load image: every image in downloadMap any of the hosts is
+// missing, and the manifest.json or repositories file tagging it.
+func streamEntries(r remote.Remote, image string, id remote.ID, downloadMap DownloadMap) ([]tarEntry, error) {
+	layers, err := r.ImageLayers(id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Docker 1.10+ images are loaded with a manifest instead
+	if len(layers) > 0 {
+		return streamV2Entries(r, image, id, layers, len(downloadMap) > 0)
+	}
+
+	ids := make([]string, 0, len(downloadMap))
+	for downloadId := range downloadMap {
+		ids = append(ids, string(downloadId))
+	}
+	sort.Strings(ids)
+
+	entries := make([]tarEntry, 0)
+	for _, downloadId := range ids {
+		imageEntries, err := keyEntries(r, remote.ImagePrefix(remote.ID(downloadId)), downloadId+"/")
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, imageEntries...)
+	}
+
+	repositories, err := repositoriesFor(image, r)
+	if err != nil {
+		return nil, err
+	} else if repositories != nil {
+		data, err := json.Marshal(&repositories)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, tarEntry{name: "repositories", data: data})
+	}
+
+	return entries, nil
+}
+
+// The config of a Docker 1.10+ image, its layers if the hosts need them, and
+// its manifest.json. docker load doesn't read the layers a host already has.
+func streamV2Entries(r remote.Remote, image string, id remote.ID, layers []remote.ID, download bool) ([]tarEntry, error) {
+	configEntries, err := keyEntries(r, remote.ImagePrefix(id), "")
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]tarEntry, 0)
+	for _, entry := range configEntries {
+		if entry.name == "config.json" {
+			entry.name = id.String() + ".json"
+			entries = append(entries, entry)
+		}
+	}
+
+	if len(entries) == 0 {
+		return nil, remote.ErrNoSuchImage
+	}
+
+	if download {
+		// an image can list the same layer more than once
+		seen := make(map[remote.ID]bool)
+		for _, layer := range layers {
+			if seen[layer] {
+				continue
+			}
+			seen[layer] = true
+
+			layerEntries, err := keyEntries(r, remote.LayerPrefix(layer), layer.String()+"/")
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, layerEntries...)
+		}
+	}
+
+	item, err := manifestFor(image, id, layers, r)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal([]manifestItem{item})
+	if err != nil {
+		return nil, err
+	}
+
+	return append(entries, tarEntry{name: "manifest.json", data: data}), nil
+}
+
+// The files on the remote below prefix, named namePrefix + the rest of the key
+func keyEntries(r remote.Remote, prefix, namePrefix string) ([]tarEntry, error) {
+	keyInfos, err := r.ListKeys(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	exists := make(map[string]bool)
+	for _, keyInfo := range keyInfos {
+		exists[keyInfo.Key] = true
+	}
+
+	entries := make([]tarEntry, 0, len(keyInfos))
+	for _, keyInfo := range keyInfos {
+		if strings.HasSuffix(keyInfo.Key, ".sum") {
+			continue
+		}
+
+		entries = append(entries, tarEntry{
+			name:   namePrefix + strings.TrimPrefix(keyInfo.Key, prefix),
+			key:    keyInfo.Key,
+			size:   keyInfo.Size,
+			hasSum: exists[keyInfo.Key+".sum"],
+		})
+	}
+
+	if len(entries) == 0 {
+		return nil, remote.ErrNoSuchImage
+	}
+
+	return entries, nil
+}
+
+// Write entries to w as a tarball, reading them from r. Files are checked
+// against their digest as they go through; as they've already been sent a
+// corrupt file fails the load rather than being downloaded again.
+func writeTarEntries(w io.Writer, r remote.Remote, entries []tarEntry) error {
+	tw := tar.NewWriter(w)
+
+	for _, entry := range entries {
+		if err := writeTarEntry(tw, r, entry); err != nil {
+			return fmt.Errorf("%s: %v", entry.name, err)
+		}
+	}
+
+	return tw.Close()
+}
+
+func writeTarEntry(tw *tar.Writer, r remote.Remote, entry tarEntry) error {
+	header := &tar.Header{
+		Name:     entry.name,
+		Mode:     0644,
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	}
+
+	if entry.key == "" {
+		header.Size = int64(len(entry.data))
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		_, err := tw.Write(entry.data)
+		return err
+	}
+
+	sum := ""
+	if entry.hasSum {
+		var err error
+		if sum, err = readSum(r, entry.key); err != nil {
+			return err
+		}
+	}
+
+	reader, err := r.OpenKey(entry.key)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	header.Size = entry.size
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	if _, err := io.CopyN(io.MultiWriter(tw, hash), reader, entry.size); err != nil {
+		return err
+	}
+
+	if sum != "" && sum != hex.EncodeToString(hash.Sum(nil)) {
+		return remote.ErrDigestMismatch
+	}
+
+	return nil
+}
+
+func readSum(r remote.Remote, key string) (string, error) {
+	reader, err := r.OpenKey(key + ".sum")
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	sum, err := ioutil.ReadAll(reader)
+	return strings.TrimSpace(string(sum)), err
+}
+
+// size of the tarball writeTarDir writes for root
+func tarDirSize(root string) (int64, error) {
+	sizes := make([]int64, 0)
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == root {
+			return err
+		}
+
+		if info.Mode().IsRegular() {
+			sizes = append(sizes, info.Size())
+		} else {
+			sizes = append(sizes, 0)
+		}
+		return nil
+	})
+
+	return tarSize(sizes), err
+}
+
+// Write the files below root to w as a tarball, as `tar cf - -C root .` would.
+func writeTarDir(w io.Writer, root string) error {
+	tw := tar.NewWriter(w)
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name, err := filepath.Rel(root, path)
+		if err != nil || name == "." {
+			return err
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(name)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, err = io.Copy(tw, file)
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// Writes to every docker host still loading the image, counting what each
+// has read. Each host reads the stream at its own pace from a buffer of its
+// own. A host that fails, or that leaves its buffer full for longer than
+// hostStallTimeout, is dropped; the others still get the whole stream.
+type hostTee struct {
+	writers  []*hostWriter
+	progress []*hostProgress
+	errMap   map[string]error
+}
+
+// how much of the stream, in writes, a host can fall behind the others
+const hostBufferSize = 64
+
+// how long a host can go without reading before it's dropped
+var hostStallTimeout = 2 * time.Minute
+
+var errHostStalled = errors.New("docker host stopped reading the image")
+
+// The stream of one host, written from its buffer as the host reads it
+type hostWriter struct {
+	w        *io.PipeWriter
+	progress *hostProgress
+	chunks   chan []byte
+
+	// closed once the buffer is written, or writing fails with err
+	done chan struct{}
+	err  error
+}
+
+func newHostTee() *hostTee {
+	return &hostTee{errMap: make(map[string]error)}
+}
+
+func (t *hostTee) add(w *io.PipeWriter, progress *hostProgress) {
+	hw := &hostWriter{
+		w:        w,
+		progress: progress,
+		chunks:   make(chan []byte, hostBufferSize),
+		done:     make(chan struct{}),
+	}
+	go hw.run()
+
+	t.writers = append(t.writers, hw)
+	t.progress = append(t.progress, progress)
+}
+
+func (hw *hostWriter) run() {
+	defer close(hw.done)
+
+	for chunk := range hw.chunks {
+		n, err := hw.w.Write(chunk)
+		hw.progress.add(n)
+
+		if err != nil {
+			hw.err = err
+			return
+		}
+	}
+}
+
+// drop host i, with the error it failed with
+func (t *hostTee) drop(i int, err error) {
+	hw := t.writers[i]
+	t.errMap[hw.progress.host] = err
+	t.writers[i] = nil
+
+	// unblocks a write the host isn't reading
+	hw.w.CloseWithError(err)
+}
+
+// Buffer chunk for the host, waiting for room up to hostStallTimeout
+func (hw *hostWriter) send(chunk []byte) error {
+	select {
+	case hw.chunks <- chunk:
+		return nil
+	default:
+	}
+
+	timer := time.NewTimer(hostStallTimeout)
+	defer timer.Stop()
+
+	select {
+	case hw.chunks <- chunk:
+		return nil
+	case <-hw.done:
+		return hw.err
+	case <-timer.C:
+		return errHostStalled
+	}
+}
+
+// Wait for the host to read the rest of its buffer, up to hostStallTimeout
+func (hw *hostWriter) wait() error {
+	close(hw.chunks)
+
+	timer := time.NewTimer(hostStallTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-hw.done:
+		return hw.err
+	case <-timer.C:
+		return errHostStalled
+	}
+}
+
+func (t *hostTee) Write(p []byte) (int, error) {
+	// p is the caller's to reuse once Write returns
+	chunk := append([]byte(nil), p...)
+	live := 0
+
+	for i, hw := range t.writers {
+		if hw == nil {
+			continue
+		}
+
+		if err := hw.send(chunk); err != nil {
+			t.drop(i, err)
+			continue
+		}
+
+		live++
+	}
+
+	if live == 0 {
+		return 0, errors.New("every docker host stopped reading the image")
+	}
+
+	return len(p), nil
+}
+
+// end the stream of the hosts still reading it, with err if it's incomplete.
+// Waits for each host to read what's left in its buffer.
+func (t *hostTee) close(err error) {
+	for i, hw := range t.writers {
+		if hw == nil {
+			continue
+		}
+
+		if waitErr := hw.wait(); waitErr != nil {
+			t.drop(i, waitErr)
+			continue
+		}
+
+		hw.w.CloseWithError(err)
+		t.writers[i] = nil
+	}
+}
+
+// loadTar runs `docker load` on every pull host, reading the tarball of
+// total bytes written by write. Progress is reported per host as they read it.
+func (cli *DogestryCli) loadTar(total int64, write func(w io.Writer) error) error {
+	type hostErrTuple struct {
+		host string
+		err  error
+	}
+
+	tee := newHostTee()
+	tupleCh := make(chan hostErrTuple)
+
+	for i, client := range cli.PullClients {
+		progress := newHostProgress(cli.PullHosts[i], total)
+
+		reader, writer := io.Pipe()
+		tee.add(writer, progress)
+
+		go func(client *docker.Client, progress *hostProgress, reader *io.PipeReader) {
+			err := client.LoadImage(docker.LoadImageOptions{InputStream: reader})
+
+			// stop writing to a host that's no longer reading
+			reader.Close()
+
+			if err != nil {
+				progress.setStatus("failed")
+			} else {
+				progress.setStatus("done")
+			}
+
+			tupleCh <- hostErrTuple{progress.host, err}
+		}(client, progress, reader)
+	}
+
+	reporter := cli.newProgressReporter(tee.progress, os.Stdout, utils.IsTerminal(os.Stdout))
+	reporter.start()
+
+	writeErr := write(tee)
+	tee.close(writeErr)
+
+	uploadImageErrMap := make(map[string]error)
+	for range cli.PullClients {
+		tuple := <-tupleCh
+		if tuple.err != nil {
+			uploadImageErrMap[tuple.host] = tuple.err
+		} else if err, ok := tee.errMap[tuple.host]; ok {
+			uploadImageErrMap[tuple.host] = err
+		}
+	}
+	close(tupleCh)
+
+	reporter.finish()
+
+	err := cli.outputStatus(cli.PullHosts, uploadImageErrMap)
+	if writeErr != nil {
+		err = fmt.Errorf("Error streaming image: %v", writeErr)
+	}
+	return err
+}
@@ -0,0 +1,267 @@
+package cli
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dogestry/dogestry/config"
+	"github.com/dogestry/dogestry/remote"
+)
+
+// a local remote holding files, each pushed with its digest
+func makeLocalRemote(t *testing.T, files map[string]string) (remote.Remote, string) {
+	remoteDir, err := ioutil.TempDir("", "dogestry-remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range files {
+		path := filepath.Join(remoteDir, name)
+		os.MkdirAll(filepath.Dir(path), 0700)
+		ioutil.WriteFile(path, []byte(content), 0600)
+		if !strings.HasPrefix(name, "repositories/") {
+			ioutil.WriteFile(path+".sum", []byte(sha256Hex(content)), 0600)
+		}
+	}
+
+	cfg, _ := config.NewConfig(false, 22375, false, false, false)
+	cfg.SetS3URL(remoteDir)
+
+	r, err := remote.NewRemote(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return r, remoteDir
+}
+
+func readTarball(t *testing.T, data []byte) map[string]string {
+	files := make(map[string]string)
+
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[header.Name] = string(content)
+	}
+
+	return files
+}
+
+func TestStreamLegacyImage(t *testing.T) {
+	r, remoteDir := makeLocalRemote(t, map[string]string{
+		"images/abc123/json":        `{"id":"abc123"}`,
+		"images/abc123/layer.tar":   "layer",
+		"images/abc123/VERSION":     "1.0",
+		"repositories/myapp/latest": "abc123",
+	})
+	defer os.RemoveAll(remoteDir)
+
+	entries, err := streamEntries(r, "myapp", "abc123", DownloadMap{"abc123": nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := writeTarEntries(buf, r, entries); err != nil {
+		t.Fatal(err)
+	}
+
+	files := readTarball(t, buf.Bytes())
+
+	expected := map[string]string{
+		"abc123/json":      `{"id":"abc123"}`,
+		"abc123/layer.tar": "layer",
+		"abc123/VERSION":   "1.0",
+		"repositories":     `{"myapp":{"latest":"abc123"}}`,
+	}
+
+	if len(files) != len(expected) {
+		t.Fatalf("expected %d files in the tarball, got %v", len(expected), files)
+	}
+	for name, content := range expected {
+		if files[name] != content {
+			t.Errorf("%s should be %q, got %q", name, content, files[name])
+		}
+	}
+}
+
+func TestStreamV2Image(t *testing.T) {
+	layer := "layer contents"
+	layerId := sha256Hex(layer)
+	config := `{"rootfs":{"type":"layers","diff_ids":["sha256:` + layerId + `"]}}`
+	configId := sha256Hex(config)
+
+	r, remoteDir := makeLocalRemote(t, map[string]string{
+		"images/" + configId + "/config.json": config,
+		"layers/" + layerId + "/layer.tar":    layer,
+		"repositories/myapp/latest":           configId,
+	})
+	defer os.RemoveAll(remoteDir)
+
+	id := remote.ID(configId)
+
+	entries, err := streamEntries(r, "myapp", id, DownloadMap{id: nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := writeTarEntries(buf, r, entries); err != nil {
+		t.Fatal(err)
+	}
+
+	files := readTarball(t, buf.Bytes())
+
+	if files[configId+".json"] != config {
+		t.Errorf("config should be loaded as %s.json, got %v", configId, files)
+	}
+	if files[layerId+"/layer.tar"] != layer {
+		t.Errorf("layer should be loaded as %s/layer.tar, got %v", layerId, files)
+	}
+
+	manifest := `[{"Config":"` + configId + `.json","RepoTags":["myapp:latest"],"Layers":["` + layerId + `/layer.tar"]}]`
+	if files["manifest.json"] != manifest {
+		t.Errorf("manifest.json should be %s, got %s", manifest, files["manifest.json"])
+	}
+}
+
+func TestStreamFailsOnDigestMismatch(t *testing.T) {
+	r, remoteDir := makeLocalRemote(t, map[string]string{
+		"images/abc123/json":      `{"id":"abc123"}`,
+		"images/abc123/layer.tar": "layer",
+		"images/abc123/VERSION":   "1.0",
+	})
+	defer os.RemoveAll(remoteDir)
+
+	ioutil.WriteFile(filepath.Join(remoteDir, "images/abc123/layer.tar"), []byte("LAYER"), 0600)
+
+	entries, err := streamEntries(r, "abc123", "abc123", DownloadMap{"abc123": nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = writeTarEntries(ioutil.Discard, r, entries)
+	if err == nil || !strings.Contains(err.Error(), remote.ErrDigestMismatch.Error()) {
+		t.Fatalf("a corrupt layer should fail the stream. Error: %v", err)
+	}
+}
+
+func TestHostTeeDropsFailedHost(t *testing.T) {
+	tee := newHostTee()
+
+	okReader, okWriter := io.Pipe()
+	failedReader, failedWriter := io.Pipe()
+	tee.add(okWriter, newHostProgress("tcp://ok:2375", 5))
+	tee.add(failedWriter, newHostProgress("tcp://failed:2375", 5))
+
+	failedReader.Close()
+
+	received := make(chan string)
+	go func() {
+		data, _ := ioutil.ReadAll(okReader)
+		received <- string(data)
+	}()
+
+	if _, err := io.WriteString(tee, "image"); err != nil {
+		t.Fatalf("writing should work while a host is still reading. Error: %v", err)
+	}
+	tee.close(nil)
+
+	if data := <-received; data != "image" {
+		t.Errorf("the remaining host should get the whole stream, got %q", data)
+	}
+
+	if _, ok := tee.errMap["tcp://failed:2375"]; !ok || len(tee.errMap) != 1 {
+		t.Errorf("only the failed host should be reported, got %v", tee.errMap)
+	}
+
+	if current := tee.progress[0].snapshot().Current; current != 5 {
+		t.Errorf("the remaining host should have read 5 bytes, got %d", current)
+	}
+	if current := tee.progress[1].snapshot().Current; current != 0 {
+		t.Errorf("the failed host should have read nothing, got %d", current)
+	}
+
+	okReader.Close()
+	if _, err := io.WriteString(tee, "more"); err == nil {
+		t.Error("writing should fail once no host is reading")
+	}
+}
+
+func TestWriteTarDir(t *testing.T) {
+	root, err := ioutil.TempDir("", "dogestry-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	os.MkdirAll(filepath.Join(root, "abc123"), 0700)
+	ioutil.WriteFile(filepath.Join(root, "abc123", "layer.tar"), []byte("layer"), 0600)
+	ioutil.WriteFile(filepath.Join(root, "repositories"), []byte("{}"), 0600)
+
+	buf := new(bytes.Buffer)
+	if err := writeTarDir(buf, root); err != nil {
+		t.Fatal(err)
+	}
+
+	files := readTarball(t, buf.Bytes())
+
+	if files["abc123/layer.tar"] != "layer" || files["repositories"] != "{}" {
+		t.Errorf("the files below root should be in the tarball, got %v", files)
+	}
+	if _, ok := files["abc123/"]; !ok {
+		t.Errorf("directories should be in the tarball, got %v", files)
+	}
+}
+
+func TestHostTeeDropsStalledHost(t *testing.T) {
+	defer func(timeout time.Duration) { hostStallTimeout = timeout }(hostStallTimeout)
+	hostStallTimeout = 50 * time.Millisecond
+
+	tee := newHostTee()
+
+	okReader, okWriter := io.Pipe()
+	_, stalledWriter := io.Pipe()
+	tee.add(okWriter, newHostProgress("tcp://ok:2375", 0))
+	tee.add(stalledWriter, newHostProgress("tcp://stalled:2375", 0))
+
+	received := make(chan int)
+	go func() {
+		data, _ := ioutil.ReadAll(okReader)
+		received <- len(data)
+	}()
+
+	// more than the stalled host can buffer
+	writes := hostBufferSize + 2
+	for i := 0; i < writes; i++ {
+		if _, err := io.WriteString(tee, "x"); err != nil {
+			t.Fatalf("writing should work while a host is still reading. Error: %v", err)
+		}
+	}
+	tee.close(nil)
+
+	if n := <-received; n != writes {
+		t.Errorf("the remaining host should get the whole stream, got %d bytes", n)
+	}
+
+	if err := tee.errMap["tcp://stalled:2375"]; err != errHostStalled || len(tee.errMap) != 1 {
+		t.Errorf("only the stalled host should be dropped, got %v", tee.errMap)
+	}
+}
@@ -0,0 +1,82 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/dogestry/dogestry/remote"
+)
+
+const TagHelpMessage string = `  Tag an image on REMOTE as DST[:TAG], without moving any layers.
+
+  SRC can be a tag or an image id, short ids work too.
+
+  Arguments:
+    REMOTE       Name of REMOTE.
+    SRC[:TAG]    Name or id of the image to tag.
+    DST[:TAG]    The new tag. TAG is optional, and defaults to 'latest'.
+
+  Options:
+    -force       Overwrite DST if it already points to another image
+
+  Examples:
+    dogestry tag s3://DockerBucket/Path/?region=us-east-1 myapp:abc123 myapp:production
+    dogestry tag -force /path/to/images 5a1b2c3d4e5f myapp:production`
+
+func (cli *DogestryCli) CmdTag(args ...string) error {
+	tagFlags := cli.Subcmd("tag", "[OPTIONS] REMOTE SRC[:TAG] DST[:TAG]", TagHelpMessage)
+	force := tagFlags.Bool("force", false, "overwrite an existing tag")
+	if err := tagFlags.Parse(args); err != nil {
+		return nil
+	}
+
+	if len(tagFlags.Args()) < 3 {
+		fmt.Fprintln(cli.err, "Error: REMOTE, SRC and DST not specified")
+		tagFlags.Usage()
+		os.Exit(2)
+	}
+
+	S3URL := tagFlags.Arg(0)
+	src := tagFlags.Arg(1)
+	dst := tagFlags.Arg(2)
+
+	cli.Config.SetS3URL(S3URL)
+
+	r, err := remote.NewRemote(cli.Config)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Remote: %v\n", r.Desc())
+
+	id, err := r.ResolveImageNameToId(src)
+	if err != nil {
+		return fmt.Errorf("%s: %v", src, err)
+	}
+
+	repoName, repoTag := remote.NormaliseImageName(dst)
+
+	existing, err := r.ParseTag(repoName, repoTag)
+	if err != nil {
+		return err
+	}
+
+	if existing == id {
+		fmt.Printf("%s:%s already points to %s\n", repoName, repoTag, id.Short())
+		return nil
+	} else if existing != "" && !*force {
+		return fmt.Errorf("%s:%s already points to %s, use -force to overwrite it", repoName, repoTag, existing.Short())
+	}
+
+	workDir, err := cli.CreateAndReturnTempDir()
+	if err != nil {
+		return err
+	}
+
+	if err := remote.WriteTag(r, repoName, repoTag, id, workDir); err != nil {
+		return err
+	}
+
+	fmt.Printf("Tagged %s as %s:%s\n", id.Short(), repoName, repoTag)
+	return nil
+}
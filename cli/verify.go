@@ -0,0 +1,81 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/dogestry/dogestry/remote"
+	"github.com/dogestry/dogestry/utils"
+)
+
+const VerifyHelpMessage string = `  Check the files on REMOTE against the sha256 digests pushed with them.
+
+  Without IMAGE every tag and every file on REMOTE is checked, otherwise
+  only IMAGE and its parents. Reports missing and corrupt files.
+
+  Arguments:
+    REMOTE       Name of REMOTE.
+    IMAGE        Name of IMAGE (with an optional :TAG), or an image id.
+
+  Examples:
+    dogestry verify s3://DockerBucket/Path/?region=us-east-1
+    dogestry verify /path/to/images ubuntu:14.04`
+
+func (cli *DogestryCli) CmdVerify(args ...string) error {
+	verifyFlags := cli.Subcmd("verify", "REMOTE [IMAGE]", VerifyHelpMessage)
+	if err := verifyFlags.Parse(args); err != nil {
+		return nil
+	}
+
+	if len(verifyFlags.Args()) < 1 {
+		fmt.Fprintln(cli.err, "Error: REMOTE not specified")
+		verifyFlags.Usage()
+		os.Exit(2)
+	}
+
+	S3URL := verifyFlags.Arg(0)
+
+	cli.Config.SetS3URL(S3URL)
+
+	r, err := remote.NewRemote(cli.Config)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Remote: %v\n", r.Desc())
+
+	verifier := remote.NewVerifier(r)
+
+	if imageName := verifyFlags.Arg(1); imageName != "" {
+		id, err := r.ResolveImageNameToId(imageName)
+		if err != nil {
+			return fmt.Errorf("%s: %v", imageName, err)
+		}
+
+		fmt.Printf("Verifying %s...\n", imageName)
+		err = verifier.VerifyImage(id)
+	} else {
+		fmt.Println("Verifying all tags and files...")
+		err = verifier.VerifyRemote()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	for _, problem := range verifier.Problems {
+		fmt.Printf("  %v\n", problem)
+	}
+
+	fmt.Printf("Verified %d files (%s)\n", verifier.Checked, utils.HumanSize(verifier.Size))
+
+	if len(verifier.NoDigest) > 0 {
+		fmt.Printf("%d files were pushed without a digest and weren't checked\n", len(verifier.NoDigest))
+	}
+
+	if len(verifier.Problems) > 0 {
+		return fmt.Errorf("%d missing or corrupt files", len(verifier.Problems))
+	}
+
+	return nil
+}
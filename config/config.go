@@ -1,16 +1,25 @@
 package config
 
 import (
+	"bufio"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	homedir "github.com/mitchellh/go-homedir"
 )
 
 const (
-	S3DefaultRegion string = "us-east-1"
+	S3DefaultRegion      string        = "us-east-1"
+	DefaultConcurrency   int           = 25
+	DefaultRetryAttempts int           = 5
+	DefaultRetryDelay    time.Duration = 500 * time.Millisecond
 )
 
 func NewConfig(useMetaService bool, serverPort int, forceLocal, requireEnvVars, disableChecks bool) (Config, error) {
@@ -42,11 +51,95 @@ func NewConfig(useMetaService bool, serverPort int, forceLocal, requireEnvVars,
 	c.ServerPort = serverPort
 	c.ForceLocal = forceLocal
 	c.DisableChecks = disableChecks
+	c.Concurrency = DefaultConcurrency
+	c.RetryAttempts = DefaultRetryAttempts
+	c.RetryDelay = DefaultRetryDelay
 
 	return c, nil
 }
 
-// Config instantiation when dogestry is ran in server mode
+// Config for the pulls of a dogestry server using its own AWS credentials:
+// from the environment, the shared credentials file (~/.aws/credentials, or
+// AWS_SHARED_CREDENTIALS_FILE, profile AWS_PROFILE) or the instance metadata
+// service. The remote is set per pull.
+func NewServerCredentialsConfig(useMetaService bool) (Config, error) {
+	c, err := NewConfig(useMetaService, 0, false, false, false)
+	if err != nil {
+		return c, err
+	}
+
+	if !useMetaService && (c.AWS.AccessKeyID == "" || c.AWS.SecretAccessKey == "") {
+		path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+		if path == "" {
+			homeDir, _ := homedir.Dir()
+			path = filepath.Join(homeDir, ".aws", "credentials")
+		}
+
+		profile := os.Getenv("AWS_PROFILE")
+		if profile == "" {
+			profile = "default"
+		}
+
+		c.AWS.AccessKeyID, c.AWS.SecretAccessKey, err = readSharedCredentials(path, profile)
+		if err != nil {
+			return c, fmt.Errorf("No AWS credentials for the server in the environment or %s: %v", path, err)
+		}
+	}
+
+	c.ServerMode = true
+
+	return c, nil
+}
+
+// read the keys of profile from an AWS shared credentials file
+func readSharedCredentials(path, profile string) (accessKey, secretKey string, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+
+	section := ""
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if section != profile || len(parts) != 2 {
+			continue
+		}
+
+		switch strings.TrimSpace(parts[0]) {
+		case "aws_access_key_id":
+			accessKey = strings.TrimSpace(parts[1])
+		case "aws_secret_access_key":
+			secretKey = strings.TrimSpace(parts[1])
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", "", err
+	}
+
+	if accessKey == "" || secretKey == "" {
+		return "", "", fmt.Errorf("no aws_access_key_id and aws_secret_access_key for profile '%s'", profile)
+	}
+
+	return accessKey, secretKey, nil
+}
+
+// Config instantiation when dogestry is ran in server mode with -legacy-auth,
+// using the AWS credentials the client sent in the X-Registry-Auth header.
 func NewServerConfig(authHeader string) (Config, error) {
 	c := Config{}
 
@@ -83,6 +176,9 @@ func NewServerConfig(authHeader string) (Config, error) {
 	}
 
 	c.ServerMode = true
+	c.Concurrency = DefaultConcurrency
+	c.RetryAttempts = DefaultRetryAttempts
+	c.RetryDelay = DefaultRetryDelay
 
 	return c, nil
 }
@@ -98,8 +194,15 @@ type AuthConfig struct {
 type Config struct {
 	ServerMode    bool
 	ServerPort    int
-	ForceLocal    bool // whether to attempt remote dogestry server usage
-	DisableChecks bool // whether to health check Docker hosts prior to pull(s)
+	ForceLocal    bool          // whether to attempt remote dogestry server usage
+	DisableChecks bool          // whether to health check Docker hosts prior to pull(s)
+	Concurrency   int           // how many files to push or pull at once
+	PartialDir    string        // where interrupted downloads are kept to be resumed
+	RetryAttempts int           // how many times to try an S3 call before giving up
+	RetryDelay    time.Duration // how long to wait before the first retry, doubled after
+	MinSuccess    int           // how many pull hosts must load an image, 0 for all of them
+	ServerToken   string        // token authenticating clients to dogestry servers
+	LegacyAuth    bool          // send (or accept) AWS credentials in X-Registry-Auth
 
 	AWS struct {
 		S3URL           *url.URL
@@ -111,6 +214,12 @@ type Config struct {
 	Docker struct {
 		Connection string
 	}
+	TLS struct {
+		Enabled bool // talk to dogestry servers over HTTPS
+		Cert    string
+		Key     string
+		CACert  string
+	}
 }
 
 func (c *Config) SetS3URL(rawurl string) error {
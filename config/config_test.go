@@ -1,7 +1,9 @@
 package config
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -37,3 +39,37 @@ func TestNewConfig(t *testing.T) {
 		t.Error("should not renturn an error")
 	}
 }
+
+func TestReadSharedCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dogestry-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "credentials")
+	content := `# comment
+[default]
+aws_access_key_id = default-access
+aws_secret_access_key = default-secret
+
+[dogestry]
+aws_access_key_id=dogestry-access
+aws_secret_access_key=dogestry-secret
+`
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	accessKey, secretKey, err := readSharedCredentials(path, "dogestry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accessKey != "dogestry-access" || secretKey != "dogestry-secret" {
+		t.Errorf("expected the keys of the dogestry profile, got %s/%s", accessKey, secretKey)
+	}
+
+	if _, _, err := readSharedCredentials(path, "missing"); err == nil {
+		t.Error("a missing profile should be an error")
+	}
+}
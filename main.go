@@ -1,15 +1,19 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/dogestry/dogestry/cli"
 	"github.com/dogestry/dogestry/config"
+	"github.com/dogestry/dogestry/remote"
 	"github.com/dogestry/dogestry/server"
 	"github.com/dogestry/dogestry/utils"
 )
@@ -39,6 +43,19 @@ var (
 	flForceLocal     bool
 	flTempDir        string
 	flDisableChecks  bool
+	flConcurrency    int
+	flRetries        int
+	flRetryDelay     time.Duration
+	flServerToken    string
+	flAllowedRemotes string
+	flLegacyAuth     bool
+	flTLS            bool
+	flTLSCert        string
+	flTLSKey         string
+	flTLSCACert      string
+	flTLSVerify      bool
+	flRegistryRemote string
+	flRegistryPush   bool
 )
 
 func init() {
@@ -59,6 +76,19 @@ func init() {
 	flag.BoolVar(&flForceLocal, "force-local", false, "do not try to use the dogestry server on host endpoints")
 	flag.StringVar(&flTempDir, "tempdir", "", "where to store temporary files created by dogestry")
 	flag.BoolVar(&flDisableChecks, "disable-checks", false, "disable health checking of remote Docker hosts during 'pull'")
+	flag.IntVar(&flConcurrency, "concurrency", config.DefaultConcurrency, "how many files to push or pull at once")
+	flag.IntVar(&flRetries, "retries", config.DefaultRetryAttempts, "how many times to try an S3 operation before giving up")
+	flag.DurationVar(&flRetryDelay, "retry-delay", config.DefaultRetryDelay, "how long to wait before retrying a failed S3 operation, doubled for each retry")
+	flag.StringVar(&flServerToken, "server-token", os.Getenv("DOGESTRY_SERVER_TOKEN"), "token authenticating clients to dogestry servers (default: $DOGESTRY_SERVER_TOKEN)")
+	flag.StringVar(&flAllowedRemotes, "allowed-remotes", "", "a comma-separated list of remotes a dogestry server may pull from with its own credentials")
+	flag.BoolVar(&flLegacyAuth, "legacy-auth", false, "send (or as a dogestry server, accept) AWS credentials in the X-Registry-Auth header")
+	flag.BoolVar(&flTLS, "tls", false, "talk to dogestry servers over HTTPS, with the certificates in DOCKER_CERT_PATH unless given")
+	flag.StringVar(&flTLSCert, "tlscert", "", "TLS certificate of the dogestry server (or client)")
+	flag.StringVar(&flTLSKey, "tlskey", "", "TLS key of the dogestry server (or client)")
+	flag.StringVar(&flTLSCACert, "tlscacert", "", "CA certificate to verify dogestry clients (or servers) with")
+	flag.BoolVar(&flTLSVerify, "tlsverify", false, "require dogestry clients to present a certificate signed by -tlscacert")
+	flag.StringVar(&flRegistryRemote, "registry-remote", "", "serve the Docker registry API (v2) from this remote in server mode")
+	flag.BoolVar(&flRegistryPush, "registry-push", false, "accept docker pushes to the registry API")
 }
 
 func main() {
@@ -82,7 +112,69 @@ func main() {
 
 		log.Printf("Running dogestry in server mode on '%v'", fullAddress)
 
-		s := server.New(fullAddress, flTempDir)
+		if flServerToken == "" && !flLegacyAuth && !flTLSVerify {
+			log.Fatal("Server mode needs -server-token or -tlsverify for clients to authenticate with (or -legacy-auth to accept their AWS credentials)")
+		}
+
+		var tlsConfig *tls.Config
+		if flTLSCert != "" || flTLSKey != "" || flTLSVerify {
+			var err error
+			if tlsConfig, err = utils.ServerTLSConfig(flTLSCert, flTLSKey, flTLSCACert, flTLSVerify); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		auth := server.Auth{Token: flServerToken, LegacyAuth: flLegacyAuth}
+		if flAllowedRemotes != "" {
+			auth.AllowedRemotes = strings.Split(flAllowedRemotes, ",")
+		}
+
+		// with -legacy-auth the server can do without credentials of its own
+		var serverCfg *config.Config
+		if cfg, err := config.NewServerCredentialsConfig(flUseMetaService); err == nil {
+			cfg.Concurrency = flConcurrency
+			cfg.RetryAttempts = flRetries
+			cfg.RetryDelay = flRetryDelay
+			serverCfg = &cfg
+		} else if !flLegacyAuth {
+			log.Fatal(err)
+		} else {
+			log.Printf("Pulling with the AWS credentials of clients only: %v", err)
+		}
+
+		s := server.New(fullAddress, flTempDir, auth, serverCfg, tlsConfig)
+
+		if flRegistryRemote != "" {
+			registryCfg := config.Config{}
+			if serverCfg != nil {
+				registryCfg = *serverCfg
+			}
+			if err := registryCfg.SetS3URL(flRegistryRemote); err != nil {
+				log.Fatalf("Unable to parse the registry remote %s: %v", flRegistryRemote, err)
+			}
+
+			r, err := remote.NewRemote(registryCfg)
+			if err != nil {
+				log.Fatalf("Unable to serve the registry API from %s: %v", flRegistryRemote, err)
+			}
+
+			// pushed blobs wait here for their manifest
+			uploadDir := ""
+			if flRegistryPush {
+				tempDir := flTempDir
+				if tempDir == "" {
+					tempDir = os.TempDir()
+				}
+
+				uploadDir = filepath.Join(tempDir, "dogestry-registry")
+				if err := os.MkdirAll(uploadDir, 0700); err != nil {
+					log.Fatal(err)
+				}
+			}
+
+			log.Printf("Serving the registry API from %s", r.Desc())
+			s.Registry = server.NewRegistry(r, uploadDir)
+		}
 		s.ServeHttp()
 	} else {
 		args := flag.Args()
@@ -94,11 +186,26 @@ func main() {
 			requireEnvVars = false
 		}
 
+		// Local remotes (bare paths or file:// URLs) don't need AWS credentials
+		if requireEnvVars && !hasS3Remote(args[1:]) {
+			requireEnvVars = false
+		}
+
 		cfg, err := config.NewConfig(flUseMetaService, flServerPort, flForceLocal, requireEnvVars, flDisableChecks)
 		if err != nil {
 			log.Fatal(err)
 		}
 
+		cfg.Concurrency = flConcurrency
+		cfg.RetryAttempts = flRetries
+		cfg.RetryDelay = flRetryDelay
+		cfg.ServerToken = flServerToken
+		cfg.LegacyAuth = flLegacyAuth
+		cfg.TLS.Enabled = flTLS
+		cfg.TLS.Cert = flTLSCert
+		cfg.TLS.Key = flTLSKey
+		cfg.TLS.CACert = flTLSCACert
+
 		dogestryCli, err := cli.NewDogestryCli(cfg, flPullHosts, flTempDir)
 		if err != nil {
 			log.Fatal(err)
@@ -117,3 +224,13 @@ func main() {
 		}
 	}
 }
+
+// Whether any of the command arguments is an S3 remote
+func hasS3Remote(args []string) bool {
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "s3://") {
+			return true
+		}
+	}
+	return false
+}
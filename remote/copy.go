@@ -0,0 +1,138 @@
+package remote
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// Copies images between two remotes, which don't have to be of the same kind.
+// Files are staged in WorkDir one image at a time, so the copy needs no more
+// local disk than the largest image.
+type Copier struct {
+	Src     Remote
+	Dst     Remote
+	WorkDir string
+
+	// layers known to be on Dst, shared by all the images copied
+	layersOnDst map[ID]bool
+}
+
+func NewCopier(src, dst Remote, workDir string) *Copier {
+	return &Copier{
+		Src:         src,
+		Dst:         dst,
+		WorkDir:     workDir,
+		layersOnDst: make(map[ID]bool),
+	}
+}
+
+// CopyTag copies repo:tag, and the images it needs that are missing on Dst.
+// The tag is written last, so Dst never has a tag pointing to an incomplete
+// image. Returns the number of images copied.
+func (copier *Copier) CopyTag(repo, tag string) (int, error) {
+	id, err := copier.Src.ParseTag(repo, tag)
+	if err != nil {
+		return 0, err
+	} else if id == "" {
+		return 0, fmt.Errorf("%v: %s:%s", ErrNoSuchTag, repo, tag)
+	}
+
+	// the tag is only written once the copy is complete
+	if dstId, err := copier.Dst.ParseTag(repo, tag); err != nil {
+		return 0, err
+	} else if dstId == id {
+		return 0, nil
+	}
+
+	missing, err := copier.missingImages(id)
+	if err != nil {
+		return 0, err
+	}
+
+	// base image first
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := copier.copyImage(missing[i]); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := WriteTag(copier.Dst, repo, tag, id, copier.WorkDir); err != nil {
+		return len(missing), err
+	}
+
+	return len(missing), nil
+}
+
+// the images in the chain starting at id that Dst doesn't have
+func (copier *Copier) missingImages(id ID) ([]ID, error) {
+	missing := make([]ID, 0)
+
+	err := copier.Src.WalkImages(id, func(id ID, image docker.Image, err error) error {
+		if err != nil {
+			return fmt.Errorf("%s: %v", id, err)
+		}
+
+		keyInfos, err := copier.Dst.ListKeys(ImagePrefix(id))
+		if err != nil {
+			return err
+		}
+
+		if len(keyInfos) == 0 {
+			missing = append(missing, id)
+		}
+
+		return nil
+	})
+
+	return missing, err
+}
+
+func (copier *Copier) copyImage(id ID) error {
+	fmt.Printf("Copying image %s\n", id.Short())
+
+	stage, err := ioutil.TempDir(copier.WorkDir, "copy")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stage)
+
+	if err := copier.Src.PullImageId(id, filepath.Join(stage, ImagePrefix(id))); err != nil {
+		return err
+	}
+
+	layers, err := copier.Src.ImageLayers(id)
+	if err != nil {
+		return err
+	}
+
+	for _, layer := range layers {
+		if copier.layersOnDst[layer] {
+			continue
+		}
+
+		exists, err := copier.Dst.LayerExists(layer)
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			if err := copier.Src.PullLayer(layer, filepath.Join(stage, LayerPrefix(layer))); err != nil {
+				return fmt.Errorf("layer %s: %v", layer.Short(), err)
+			}
+		}
+	}
+
+	if err := copier.Dst.Push(id.String(), stage); err != nil {
+		return err
+	}
+
+	for _, layer := range layers {
+		copier.layersOnDst[layer] = true
+	}
+
+	return nil
+}
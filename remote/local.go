@@ -0,0 +1,452 @@
+package remote
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/dogestry/dogestry/config"
+	"github.com/dogestry/dogestry/utils"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// LocalRemote stores images in a directory on the local filesystem (or any
+// mounted filesystem such as NFS), using the same layout as the S3 remote.
+type LocalRemote struct {
+	config config.Config
+	Path   string
+
+	// every image or layer pulled, whichever pool it's from
+	transfers utils.Limiter
+}
+
+func NewLocalRemote(config config.Config) (*LocalRemote, error) {
+	path := config.AWS.S3URL.Path
+	if path == "" {
+		return nil, fmt.Errorf("%v: no path given for local remote", ErrInvalidRemote)
+	}
+
+	concurrency := config.Concurrency
+	if concurrency < 1 {
+		concurrency = PushNumGoroutines
+	}
+
+	return &LocalRemote{
+		config:    config,
+		Path:      filepath.Clean(path),
+		transfers: utils.NewLimiter(concurrency),
+	}, nil
+}
+
+func (remote *LocalRemote) Validate() error {
+	info, err := os.Stat(remote.Path)
+	if err != nil {
+		return fmt.Errorf("%s unable to access directory: %s", remote.Desc(), err)
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", remote.Desc())
+	}
+
+	return nil
+}
+
+// Remote: describe the remote
+func (remote *LocalRemote) Desc() string {
+	return fmt.Sprintf("local(path=%s)", remote.Path)
+}
+
+func (remote *LocalRemote) Push(image, imageRoot string) error {
+	println("Pushing files to local remote:")
+
+	count := 0
+	skipped := 0
+	var skippedSize int64
+
+	err := filepath.Walk(imageRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || strings.HasSuffix(path, ".sum") {
+			return nil
+		}
+
+		key, err := filepath.Rel(imageRoot, path)
+		if err != nil {
+			return err
+		}
+
+		dst := filepath.Join(remote.Path, key)
+
+		if unchanged, err := sameSum(path, dst); err != nil {
+			return err
+		} else if unchanged {
+			skipped++
+			skippedSize += info.Size()
+			return nil
+		}
+
+		sum, err := copyFile(path, dst, "")
+		if err != nil {
+			return err
+		}
+
+		count++
+
+		// the sum goes in once the file is complete
+		_, err = writeFile(dst+".sum", strings.NewReader(sum), "")
+		return err
+	})
+
+	if err != nil {
+		return fmt.Errorf("Error when copying to local remote: %v", err)
+	}
+
+	if skipped > 0 {
+		log.Printf("Skipped %d unchanged files (%s)", skipped, utils.HumanSize(skippedSize))
+	}
+
+	if count == 0 {
+		log.Println("There are no files to push")
+	}
+
+	return nil
+}
+
+func (remote *LocalRemote) PullImageId(id ID, dst string) error {
+	return remote.transfers.Run(func() error {
+		return copyDir(remote.imagePath(id), dst)
+	})
+}
+
+func (remote *LocalRemote) PullLayer(digest ID, dst string) error {
+	err := remote.transfers.Run(func() error {
+		return copyDir(remote.layerPath(digest), dst)
+	})
+	if os.IsNotExist(err) {
+		return ErrNoSuchImage
+	}
+	return err
+}
+
+func (remote *LocalRemote) LayerExists(digest ID) (bool, error) {
+	_, err := os.Stat(filepath.Join(remote.layerPath(digest), "layer.tar"))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (remote *LocalRemote) ImageLayers(id ID) ([]ID, error) {
+	configJson, err := ioutil.ReadFile(filepath.Join(remote.imagePath(id), "config.json"))
+	if os.IsNotExist(err) {
+		// legacy image
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	config, err := ParseImageConfig(configJson)
+	if err != nil {
+		return nil, err
+	}
+
+	return config.Layers(), nil
+}
+
+func (remote *LocalRemote) ParseTag(repo, tag string) (ID, error) {
+	file, err := ioutil.ReadFile(remote.tagFilePath(repo, tag))
+	if os.IsNotExist(err) {
+		// doesn't exist yet, deal with it
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	return ID(strings.TrimSpace(string(file))), nil
+}
+
+func (remote *LocalRemote) ResolveImageNameToId(image string) (ID, error) {
+	return ResolveImageNameToId(remote, image)
+}
+
+func (remote *LocalRemote) ImageFullId(id ID) (ID, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(remote.Path, "images"))
+	if os.IsNotExist(err) {
+		return "", ErrNoSuchImage
+	} else if err != nil {
+		return "", err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), string(id)) {
+			return ID(entry.Name()), nil
+		}
+	}
+
+	return "", ErrNoSuchImage
+}
+
+func (remote *LocalRemote) WalkImages(id ID, walker ImageWalkFn) error {
+	return WalkImages(remote, id, walker)
+}
+
+func (remote *LocalRemote) ImageMetadata(id ID) (docker.Image, error) {
+	image := docker.Image{}
+
+	// Docker 1.10+ images only have a config, their layers are stored separately
+	configJson, err := ioutil.ReadFile(filepath.Join(remote.imagePath(id), "config.json"))
+	if err == nil {
+		return imageFromConfig(id, configJson)
+	} else if !os.IsNotExist(err) {
+		return image, err
+	}
+
+	files := []string{"json", "layer.tar", "VERSION"}
+	for i := 0; i < len(files); i++ {
+		_, err := os.Stat(filepath.Join(remote.imagePath(id), files[i]))
+		if os.IsNotExist(err) {
+			return image, ErrNoSuchImage
+		} else if err != nil {
+			return image, err
+		}
+	}
+
+	imageJson, err := ioutil.ReadFile(filepath.Join(remote.imagePath(id), "json"))
+	if err != nil {
+		return image, err
+	}
+
+	return parseImageJson(imageJson)
+}
+
+func (remote *LocalRemote) ParseImagePath(path string, prefix string) (repo, tag string) {
+	return ParseImagePath(path, prefix)
+}
+
+func (remote *LocalRemote) List() (images []Image, err error) {
+	reposRoot := filepath.Join(remote.Path, "repositories")
+
+	err = filepath.Walk(reposRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// skip in-flight copies (see copyFile) and sum files
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") || strings.HasSuffix(path, ".sum") {
+			return nil
+		}
+
+		key, err := filepath.Rel(remote.Path, path)
+		if err != nil {
+			return err
+		}
+
+		repo, tag := remote.ParseImagePath(filepath.ToSlash(key), "repositories/")
+		images = append(images, Image{repo, tag})
+
+		return nil
+	})
+
+	if os.IsNotExist(err) {
+		return images, nil
+	} else if err != nil {
+		log.Printf("%s unable to list images: %s", remote.Desc(), err)
+		return images, err
+	}
+
+	return images, nil
+}
+
+func (remote *LocalRemote) ListKeys(prefix string) ([]KeyInfo, error) {
+	keyInfos := make([]KeyInfo, 0)
+
+	// only walk the directory the prefix points into
+	dir := prefix
+	if !strings.HasSuffix(prefix, "/") {
+		dir = path.Dir(prefix)
+	}
+
+	err := filepath.Walk(filepath.Join(remote.Path, filepath.FromSlash(dir)), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// skip in-flight copies (see copyFile)
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(remote.Path, path)
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(relPath)
+		if strings.HasPrefix(key, prefix) {
+			keyInfos = append(keyInfos, KeyInfo{
+				Key:          key,
+				Size:         info.Size(),
+				LastModified: info.ModTime(),
+			})
+		}
+
+		return nil
+	})
+
+	if os.IsNotExist(err) {
+		return keyInfos, nil
+	}
+
+	return keyInfos, err
+}
+
+func (remote *LocalRemote) RemoveKeys(keys []string) error {
+	for _, key := range keys {
+		file := filepath.Join(remote.Path, filepath.FromSlash(key))
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		// clean up empty dirs, otherwise removed images could still be
+		// found by ImageFullId
+		for dir := filepath.Dir(file); dir != remote.Path && strings.HasPrefix(dir, remote.Path); dir = filepath.Dir(dir) {
+			if err := os.Remove(dir); err != nil {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+func (remote *LocalRemote) OpenKey(key string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(remote.Path, filepath.FromSlash(key)))
+}
+
+// path to a tagfile
+func (remote *LocalRemote) tagFilePath(repo, tag string) string {
+	return filepath.Join(remote.Path, "repositories", repo, tag)
+}
+
+// path to an image dir
+func (remote *LocalRemote) imagePath(id ID) string {
+	return filepath.Join(remote.Path, "images", string(id))
+}
+
+// path to a content addressed layer dir
+func (remote *LocalRemote) layerPath(digest ID) string {
+	return filepath.Join(remote.Path, "layers", digest.String())
+}
+
+// whether dst exists with a sum matching src
+func sameSum(src, dst string) (bool, error) {
+	sum, err := ioutil.ReadFile(dst + ".sum")
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if _, err := os.Stat(dst); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	srcSum, err := utils.Sha256File(src)
+	if err != nil {
+		return false, err
+	}
+
+	return strings.TrimSpace(string(sum)) == srcSum, nil
+}
+
+// copy src to dst through a temporary file, so readers on a shared filesystem
+// never see it partially written, returning the sha256 of the file. If sum is
+// given the copy fails unless it matches.
+func copyFile(src, dst, sum string) (string, error) {
+	log.Printf("Copying %s (%s)\n", dst, utils.FileHumanSize(src))
+
+	from, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer from.Close()
+
+	return writeFile(dst, from, sum)
+}
+
+// write the contents of from to dst through a temp file, so that dst only
+// ever has the complete file. Returns the sha256 of the contents, and fails
+// if sum is given and doesn't match.
+func writeFile(dst string, from io.Reader, sum string) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", err
+	}
+
+	to, err := ioutil.TempFile(filepath.Dir(dst), "."+filepath.Base(dst))
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(to.Name())
+
+	hash := sha256.New()
+
+	if _, err := io.Copy(io.MultiWriter(to, hash), from); err != nil {
+		to.Close()
+		return "", err
+	}
+
+	if err := to.Close(); err != nil {
+		return "", err
+	}
+
+	digest := hex.EncodeToString(hash.Sum(nil))
+	if sum != "" && sum != digest {
+		return "", fmt.Errorf("%v: %s", ErrDigestMismatch, dst)
+	}
+
+	if err := os.Chmod(to.Name(), 0644); err != nil {
+		return "", err
+	}
+
+	return digest, os.Rename(to.Name(), dst)
+}
+
+// copy the files in src to dst, checking them against their sums. The sum
+// files themselves aren't copied.
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || strings.HasSuffix(path, ".sum") {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		sum, err := ioutil.ReadFile(path + ".sum")
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		_, err = copyFile(path, filepath.Join(dst, relPath), strings.TrimSpace(string(sum)))
+		return err
+	})
+}
@@ -0,0 +1,524 @@
+package remote
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dogestry/dogestry/config"
+	docker "github.com/fsouza/go-dockerclient"
+	. "gopkg.in/check.v1"
+)
+
+type LocalS struct {
+	remote    *LocalRemote
+	RemoteDir string
+	TempDir   string
+}
+
+var _ = Suite(&LocalS{})
+
+func (s *LocalS) SetUpTest(c *C) {
+	s.RemoteDir = c.MkDir()
+	s.TempDir = c.MkDir()
+
+	cfg, err := config.NewConfig(false, 22375, false, false, false)
+	if err != nil {
+		c.Fatalf("couldn't initialize config. Error: %s", err)
+	}
+	cfg.SetS3URL("file://" + s.RemoteDir)
+
+	r, err := NewRemote(cfg)
+	c.Assert(err, IsNil)
+
+	s.remote = r.(*LocalRemote)
+}
+
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *LocalS) pushTestImage(c *C) {
+	imageRoot := filepath.Join(s.TempDir, "push")
+
+	dumpFile(imageRoot, "images/abc123/json", `{"id":"abc123","parent":"def456"}`)
+	dumpFile(imageRoot, "images/abc123/layer.tar", "layer")
+	dumpFile(imageRoot, "images/abc123/VERSION", "1.0")
+	dumpFile(imageRoot, "images/def456/json", `{"id":"def456"}`)
+	dumpFile(imageRoot, "images/def456/layer.tar", "layer")
+	dumpFile(imageRoot, "images/def456/VERSION", "1.0")
+	dumpFile(imageRoot, "repositories/myapp/latest", "abc123")
+
+	c.Assert(s.remote.Push("myapp", imageRoot), IsNil)
+}
+
+func (s *LocalS) TestNewRemoteDispatch(c *C) {
+	cfg, _ := config.NewConfig(false, 22375, false, false, false)
+
+	cfg.SetS3URL(s.RemoteDir)
+	r, err := NewRemote(cfg)
+	c.Assert(err, IsNil)
+	c.Assert(r.Desc(), Equals, "local(path="+s.RemoteDir+")")
+
+	cfg.SetS3URL("ftp://example.com/images")
+	_, err = NewRemote(cfg)
+	c.Assert(err, Not(IsNil))
+
+	cfg.SetS3URL(filepath.Join(s.RemoteDir, "missing"))
+	_, err = NewRemote(cfg)
+	c.Assert(err, Not(IsNil))
+}
+
+func (s *LocalS) TestPushAndParseTag(c *C) {
+	s.pushTestImage(c)
+
+	id, err := s.remote.ParseTag("myapp", "latest")
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, ID("abc123"))
+
+	id, err = s.remote.ParseTag("myapp", "missing")
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, ID(""))
+
+	id, err = s.remote.ResolveImageNameToId("def")
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, ID("def456"))
+}
+
+func (s *LocalS) TestWalkImages(c *C) {
+	s.pushTestImage(c)
+
+	var walked []ID
+	err := s.remote.WalkImages("abc123", func(id ID, image docker.Image, err error) error {
+		walked = append(walked, id)
+		return err
+	})
+	c.Assert(err, IsNil)
+	c.Assert(walked, DeepEquals, []ID{"abc123", "def456"})
+
+	_, err = s.remote.ImageMetadata("nope")
+	c.Assert(err, Equals, ErrNoSuchImage)
+}
+
+func (s *LocalS) TestList(c *C) {
+	s.pushTestImage(c)
+
+	images, err := s.remote.List()
+	c.Assert(err, IsNil)
+	c.Assert(images, DeepEquals, []Image{{"myapp", "latest"}})
+}
+
+func (s *LocalS) TestPullImageId(c *C) {
+	s.pushTestImage(c)
+
+	dst := filepath.Join(s.TempDir, "pull", "abc123")
+	c.Assert(s.remote.PullImageId("abc123", dst), IsNil)
+
+	for _, name := range []string{"json", "layer.tar", "VERSION"} {
+		_, err := os.Stat(filepath.Join(dst, name))
+		c.Assert(err, IsNil)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dst, "layer.tar"))
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "layer")
+}
+
+func (s *LocalS) TestV2Image(c *C) {
+	imageRoot := filepath.Join(s.TempDir, "push")
+
+	dumpFile(imageRoot, "images/cfg123/config.json", `{"created":"2016-02-01T00:00:00Z","rootfs":{"type":"layers","diff_ids":["sha256:aaa","sha256:bbb"]}}`)
+	dumpFile(imageRoot, "layers/aaa/layer.tar", "base layer")
+	dumpFile(imageRoot, "layers/bbb/layer.tar", "top layer")
+	dumpFile(imageRoot, "repositories/myapp/v2", "cfg123")
+
+	c.Assert(s.remote.Push("myapp:v2", imageRoot), IsNil)
+
+	image, err := s.remote.ImageMetadata("cfg123")
+	c.Assert(err, IsNil)
+	c.Assert(image.ID, Equals, "cfg123")
+	c.Assert(image.Parent, Equals, "")
+
+	layers, err := s.remote.ImageLayers("cfg123")
+	c.Assert(err, IsNil)
+	c.Assert(layers, DeepEquals, []ID{"aaa", "bbb"})
+
+	exists, err := s.remote.LayerExists("bbb")
+	c.Assert(err, IsNil)
+	c.Assert(exists, Equals, true)
+
+	exists, err = s.remote.LayerExists("ccc")
+	c.Assert(err, IsNil)
+	c.Assert(exists, Equals, false)
+
+	dst := filepath.Join(s.TempDir, "pull", "aaa")
+	c.Assert(s.remote.PullLayer("aaa", dst), IsNil)
+	content, err := ioutil.ReadFile(filepath.Join(dst, "layer.tar"))
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "base layer")
+
+	c.Assert(s.remote.PullLayer("ccc", dst), Equals, ErrNoSuchImage)
+}
+
+func (s *LocalS) TestLegacyImageHasNoLayers(c *C) {
+	s.pushTestImage(c)
+
+	layers, err := s.remote.ImageLayers("abc123")
+	c.Assert(err, IsNil)
+	c.Assert(layers, HasLen, 0)
+}
+
+func (s *LocalS) TestListAndRemoveKeys(c *C) {
+	s.pushTestImage(c)
+
+	keyInfos, err := s.remote.ListKeys(ImagePrefix("abc123"))
+	c.Assert(err, IsNil)
+	c.Assert(keyNames(keyInfos), DeepEquals, []string{
+		"images/abc123/VERSION", "images/abc123/VERSION.sum",
+		"images/abc123/json", "images/abc123/json.sum",
+		"images/abc123/layer.tar", "images/abc123/layer.tar.sum",
+	})
+	c.Assert(keyInfos[0].Size, Equals, int64(3))
+
+	keyInfos, err = s.remote.ListKeys("images/abc")
+	c.Assert(err, IsNil)
+	c.Assert(keyInfos, HasLen, 6)
+
+	c.Assert(s.remote.RemoveKeys(keyNames(keyInfos)), IsNil)
+
+	_, err = s.remote.ImageFullId("abc")
+	c.Assert(err, Equals, ErrNoSuchImage)
+
+	keyInfos, err = s.remote.ListKeys("images/")
+	c.Assert(err, IsNil)
+	c.Assert(keyInfos, HasLen, 6)
+}
+
+func (s *LocalS) TestUnreferencedGarbage(c *C) {
+	s.pushTestImage(c)
+
+	// a second tag sharing the parent image
+	imageRoot := filepath.Join(s.TempDir, "push2")
+	dumpFile(imageRoot, "images/fed789/json", `{"id":"fed789","parent":"def456"}`)
+	dumpFile(imageRoot, "images/fed789/layer.tar", "layer")
+	dumpFile(imageRoot, "images/fed789/VERSION", "1.0")
+	dumpFile(imageRoot, "repositories/other/latest", "fed789")
+	c.Assert(s.remote.Push("other", imageRoot), IsNil)
+
+	refs, err := FindReferences(s.remote, Image{"myapp", "latest"})
+	c.Assert(err, IsNil)
+	c.Assert(refs.Images, DeepEquals, map[ID]bool{"fed789": true, "def456": true})
+
+	garbage, err := UnreferencedGarbage(s.remote, "abc123", refs)
+	c.Assert(err, IsNil)
+	c.Assert(garbage, HasLen, 1)
+	c.Assert(garbage[0].Prefix, Equals, "images/abc123/")
+	c.Assert(garbage[0].Keys, DeepEquals, []string{
+		"images/abc123/VERSION", "images/abc123/VERSION.sum",
+		"images/abc123/json", "images/abc123/json.sum",
+		"images/abc123/layer.tar", "images/abc123/layer.tar.sum",
+	})
+	c.Assert(time.Since(garbage[0].LastModified) < time.Minute, Equals, true)
+
+	// just pushed, too young to remove
+	c.Assert(OlderThan(garbage, time.Now().Add(-time.Hour)), HasLen, 0)
+
+	refs, err = FindReferences(s.remote)
+	c.Assert(err, IsNil)
+
+	garbage, err = UnreferencedGarbage(s.remote, "abc123", refs)
+	c.Assert(err, IsNil)
+	c.Assert(garbage, HasLen, 0)
+}
+
+func (s *LocalS) TestFindReferencesIncompleteImages(c *C) {
+	s.pushTestImage(c)
+
+	// its layer never made it, the json still tells the parent
+	c.Assert(os.Remove(filepath.Join(s.RemoteDir, "images/abc123/layer.tar")), IsNil)
+
+	refs, err := FindReferences(s.remote)
+	c.Assert(err, IsNil)
+	c.Assert(refs.Images, DeepEquals, map[ID]bool{"abc123": true, "def456": true})
+
+	// nothing left to find the parent with
+	c.Assert(os.Remove(filepath.Join(s.RemoteDir, "images/abc123/json")), IsNil)
+
+	_, err = FindReferences(s.remote)
+	c.Assert(err, ErrorMatches, "Tag myapp:latest is broken.*")
+}
+
+func (s *LocalS) TestFindGarbage(c *C) {
+	s.pushTestImage(c)
+
+	imageRoot := filepath.Join(s.TempDir, "push2")
+	dumpFile(imageRoot, "images/old111/json", `{"id":"old111"}`)
+	dumpFile(imageRoot, "images/old111/layer.tar", "old layer")
+	dumpFile(imageRoot, "images/old111/VERSION", "1.0")
+	dumpFile(imageRoot, "images/new222/json", `{"id":"new222"}`)
+	dumpFile(imageRoot, "layers/ccc/layer.tar", "orphan layer")
+	c.Assert(s.remote.Push("", imageRoot), IsNil)
+
+	longAgo := time.Now().Add(-48 * time.Hour)
+	for _, key := range []string{"images/old111/json", "images/old111/layer.tar", "images/old111/VERSION", "layers/ccc/layer.tar"} {
+		c.Assert(os.Chtimes(filepath.Join(s.RemoteDir, key), longAgo, longAgo), IsNil)
+		c.Assert(os.Chtimes(filepath.Join(s.RemoteDir, key+".sum"), longAgo, longAgo), IsNil)
+	}
+
+	refs, err := FindReferences(s.remote)
+	c.Assert(err, IsNil)
+
+	garbage, err := FindGarbage(s.remote, refs, time.Now().Add(-24*time.Hour))
+	c.Assert(err, IsNil)
+	c.Assert(garbage, HasLen, 2)
+
+	c.Assert(garbage[0].Prefix, Equals, "images/old111/")
+	c.Assert(garbage[0].Keys, HasLen, 6)
+	c.Assert(garbage[0].Size, Equals, int64(len(`{"id":"old111"}`)+len("old layer")+len("1.0")+3*64))
+
+	c.Assert(garbage[1].Prefix, Equals, "layers/ccc/")
+	c.Assert(garbage[1].Keys, DeepEquals, []string{"layers/ccc/layer.tar", "layers/ccc/layer.tar.sum"})
+
+	// tagged by a push that skipped the unchanged files, after gc marked
+	c.Assert(WriteTag(s.remote, "revived", "latest", "old111", s.TempDir), IsNil)
+
+	refs, err = FindReferences(s.remote)
+	c.Assert(err, IsNil)
+
+	garbage = Unreferenced(garbage, refs)
+	c.Assert(garbage, HasLen, 1)
+	c.Assert(garbage[0].Prefix, Equals, "layers/ccc/")
+}
+
+func (s *LocalS) TestListTags(c *C) {
+	s.pushTestImage(c)
+
+	tags, err := ListTags(s.remote)
+	c.Assert(err, IsNil)
+	c.Assert(tags, HasLen, 1)
+	c.Assert(tags[0].Image, Equals, Image{"myapp", "latest"})
+	c.Assert(time.Since(tags[0].LastModified) < time.Minute, Equals, true)
+}
+
+func keyNames(keyInfos []KeyInfo) []string {
+	names := make([]string, 0, len(keyInfos))
+	for _, keyInfo := range keyInfos {
+		names = append(names, keyInfo.Key)
+	}
+	return names
+}
+
+func (s *LocalS) newLocalRemote(c *C) *LocalRemote {
+	cfg, _ := config.NewConfig(false, 22375, false, false, false)
+	cfg.SetS3URL(c.MkDir())
+
+	r, err := NewRemote(cfg)
+	c.Assert(err, IsNil)
+	return r.(*LocalRemote)
+}
+
+func (s *LocalS) TestCopyTag(c *C) {
+	s.pushTestImage(c)
+
+	dst := s.newLocalRemote(c)
+
+	// the parent image is already there
+	imageRoot := filepath.Join(s.TempDir, "dst")
+	dumpFile(imageRoot, "images/def456/json", `{"id":"def456"}`)
+	c.Assert(dst.Push("", imageRoot), IsNil)
+
+	copier := NewCopier(s.remote, dst, c.MkDir())
+
+	copied, err := copier.CopyTag("myapp", "latest")
+	c.Assert(err, IsNil)
+	c.Assert(copied, Equals, 1)
+
+	id, err := dst.ParseTag("myapp", "latest")
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, ID("abc123"))
+
+	keyInfos, err := dst.ListKeys("images/")
+	c.Assert(err, IsNil)
+	c.Assert(keyNames(keyInfos), DeepEquals, []string{
+		"images/abc123/VERSION", "images/abc123/VERSION.sum",
+		"images/abc123/json", "images/abc123/json.sum",
+		"images/abc123/layer.tar", "images/abc123/layer.tar.sum",
+		"images/def456/json", "images/def456/json.sum",
+	})
+
+	// up to date
+	copied, err = copier.CopyTag("myapp", "latest")
+	c.Assert(err, IsNil)
+	c.Assert(copied, Equals, 0)
+
+	_, err = copier.CopyTag("myapp", "missing")
+	c.Assert(err, ErrorMatches, "No such tag: myapp:missing")
+}
+
+func (s *LocalS) TestCopyTagV2Image(c *C) {
+	imageRoot := filepath.Join(s.TempDir, "push")
+	dumpFile(imageRoot, "images/cfg123/config.json", `{"rootfs":{"type":"layers","diff_ids":["sha256:aaa","sha256:bbb"]}}`)
+	dumpFile(imageRoot, "layers/aaa/layer.tar", "base layer")
+	dumpFile(imageRoot, "layers/bbb/layer.tar", "top layer")
+	dumpFile(imageRoot, "repositories/myapp/v2", "cfg123")
+	c.Assert(s.remote.Push("myapp:v2", imageRoot), IsNil)
+
+	dst := s.newLocalRemote(c)
+
+	// the base layer is shared with another image already there
+	imageRoot = filepath.Join(s.TempDir, "dst")
+	dumpFile(imageRoot, "layers/aaa/layer.tar", "base layer")
+	c.Assert(dst.Push("", imageRoot), IsNil)
+	c.Assert(os.Chtimes(filepath.Join(dst.Path, "layers/aaa/layer.tar"), time.Unix(0, 0), time.Unix(0, 0)), IsNil)
+
+	copied, err := NewCopier(s.remote, dst, c.MkDir()).CopyTag("myapp", "v2")
+	c.Assert(err, IsNil)
+	c.Assert(copied, Equals, 1)
+
+	keyInfos, err := dst.ListKeys("")
+	c.Assert(err, IsNil)
+	c.Assert(keyNames(keyInfos), DeepEquals, []string{
+		"images/cfg123/config.json", "images/cfg123/config.json.sum",
+		"layers/aaa/layer.tar", "layers/aaa/layer.tar.sum",
+		"layers/bbb/layer.tar", "layers/bbb/layer.tar.sum",
+		"repositories/myapp/v2", "repositories/myapp/v2.sum",
+	})
+
+	// the existing layer wasn't rewritten
+	c.Assert(keyInfos[2].LastModified.Unix(), Equals, int64(0))
+}
+
+func (s *LocalS) TestWriteTag(c *C) {
+	s.pushTestImage(c)
+
+	id, err := s.remote.ResolveImageNameToId("abc")
+	c.Assert(err, IsNil)
+
+	c.Assert(WriteTag(s.remote, "myapp", "production", id, c.MkDir()), IsNil)
+
+	id, err = s.remote.ParseTag("myapp", "production")
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, ID("abc123"))
+
+	images, err := s.remote.List()
+	c.Assert(err, IsNil)
+	c.Assert(images, DeepEquals, []Image{{"myapp", "latest"}, {"myapp", "production"}})
+}
+
+func (s *LocalS) TestImageSize(c *C) {
+	s.pushTestImage(c)
+
+	size, err := ImageSize(s.remote, "abc123")
+	c.Assert(err, IsNil)
+	c.Assert(size, Equals, int64(len(`{"id":"abc123","parent":"def456"}`)+len(`{"id":"def456"}`)+2*len("layer")+2*len("1.0")))
+
+	imageRoot := filepath.Join(s.TempDir, "push2")
+	dumpFile(imageRoot, "images/cfg123/config.json", `{"rootfs":{"type":"layers","diff_ids":["sha256:aaa","sha256:aaa"]}}`)
+	dumpFile(imageRoot, "layers/aaa/layer.tar", "base layer")
+	c.Assert(s.remote.Push("", imageRoot), IsNil)
+
+	// dangling tag
+	size, err = ImageSize(s.remote, "nope")
+	c.Assert(err, IsNil)
+	c.Assert(size, Equals, int64(0))
+
+	// repeated layers count once
+	size, err = ImageSize(s.remote, "cfg123")
+	c.Assert(err, IsNil)
+	c.Assert(size, Equals, int64(len(`{"rootfs":{"type":"layers","diff_ids":["sha256:aaa","sha256:aaa"]}}`)+len("base layer")))
+}
+
+func (s *LocalS) TestImageMetadataSavedKeys(c *C) {
+	imageRoot := filepath.Join(s.TempDir, "push")
+	dumpFile(imageRoot, "images/abc123/json", `{"id":"abc123","docker_version":"1.9.1","container_config":{"Cmd":["/bin/sh","-c","make"]}}`)
+	dumpFile(imageRoot, "images/abc123/layer.tar", "layer")
+	dumpFile(imageRoot, "images/abc123/VERSION", "1.0")
+	c.Assert(s.remote.Push("", imageRoot), IsNil)
+
+	image, err := s.remote.ImageMetadata("abc123")
+	c.Assert(err, IsNil)
+	c.Assert(image.DockerVersion, Equals, "1.9.1")
+	c.Assert(image.ContainerConfig.Cmd, DeepEquals, []string{"/bin/sh", "-c", "make"})
+}
+
+func (s *LocalS) TestPushWritesSums(c *C) {
+	s.pushTestImage(c)
+
+	sum, err := ioutil.ReadFile(filepath.Join(s.RemoteDir, "images/abc123/layer.tar.sum"))
+	c.Assert(err, IsNil)
+	c.Assert(string(sum), Equals, sha256Hex("layer"))
+
+	// sum files are never pulled
+	dst := filepath.Join(s.TempDir, "pull")
+	c.Assert(s.remote.PullImageId("abc123", dst), IsNil)
+
+	_, err = os.Stat(filepath.Join(dst, "layer.tar.sum"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	// a corrupt file fails the pull
+	dumpFile(s.RemoteDir, "images/abc123/layer.tar", "corrupt")
+	err = s.remote.PullImageId("abc123", filepath.Join(s.TempDir, "pull2"))
+	c.Assert(err, ErrorMatches, "Digest mismatch: .*layer.tar")
+}
+
+func (s *LocalS) TestVerify(c *C) {
+	s.pushTestImage(c)
+
+	verifier := NewVerifier(s.remote)
+	c.Assert(verifier.VerifyRemote(), IsNil)
+	c.Assert(verifier.Problems, HasLen, 0)
+	c.Assert(verifier.Checked, Equals, 7)
+	c.Assert(verifier.NoDigest, HasLen, 0)
+
+	dumpFile(s.RemoteDir, "images/def456/layer.tar", "corrupt")
+	c.Assert(os.Remove(filepath.Join(s.RemoteDir, "images/abc123/VERSION")), IsNil)
+	dumpFile(s.RemoteDir, "repositories/myapp/unsummed", "abc123")
+
+	verifier = NewVerifier(s.remote)
+	c.Assert(verifier.VerifyRemote(), IsNil)
+	c.Assert(verifier.Problems, DeepEquals, []Problem{
+		{"images/abc123/", ErrNoSuchImage},
+		{"images/abc123/VERSION", ErrMissingFile},
+		{"images/def456/layer.tar", ErrDigestMismatch},
+	})
+	c.Assert(verifier.NoDigest, DeepEquals, []string{"repositories/myapp/unsummed"})
+
+	// just the one chain
+	verifier = NewVerifier(s.remote)
+	c.Assert(verifier.VerifyImage("def456"), IsNil)
+	c.Assert(verifier.Problems, DeepEquals, []Problem{{"images/def456/layer.tar", ErrDigestMismatch}})
+	c.Assert(verifier.Checked, Equals, 2)
+
+	// the incomplete image's json leads on to its parent
+	verifier = NewVerifier(s.remote)
+	c.Assert(verifier.VerifyImage("abc123"), IsNil)
+	c.Assert(verifier.Problems, DeepEquals, []Problem{
+		{"images/abc123/", ErrNoSuchImage},
+		{"images/abc123/VERSION", ErrMissingFile},
+		{"images/def456/layer.tar", ErrDigestMismatch},
+	})
+}
+
+func (s *LocalS) TestPushSkipsUnchangedFiles(c *C) {
+	s.pushTestImage(c)
+
+	layer := filepath.Join(s.RemoteDir, "images/abc123/layer.tar")
+	longAgo := time.Now().Add(-48 * time.Hour)
+	c.Assert(os.Chtimes(layer, longAgo, longAgo), IsNil)
+
+	imageRoot := filepath.Join(s.TempDir, "push")
+	dumpFile(imageRoot, "repositories/myapp/latest", "def456")
+	c.Assert(s.remote.Push("myapp", imageRoot), IsNil)
+
+	info, err := os.Stat(layer)
+	c.Assert(err, IsNil)
+	c.Assert(info.ModTime().Unix(), Equals, longAgo.Unix())
+
+	id, err := s.remote.ParseTag("myapp", "latest")
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, ID("def456"))
+}
@@ -0,0 +1,301 @@
+package remote
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// Images and layers that are reachable from tags on a remote
+type References struct {
+	Images map[ID]bool
+	Layers map[ID]bool
+}
+
+func NewReferences() References {
+	return References{
+		Images: make(map[ID]bool),
+		Layers: make(map[ID]bool),
+	}
+}
+
+// FindReferences marks every image reachable from the tags on the remote,
+// along with their layers. Tags in exclude are skipped, which is how to find
+// out what would become unreferenced when they're removed.
+func FindReferences(r Remote, exclude ...Image) (References, error) {
+	refs := NewReferences()
+
+	images, err := r.List()
+	if err != nil {
+		return refs, err
+	}
+
+	excluded := make(map[Image]bool)
+	for _, image := range exclude {
+		excluded[image] = true
+	}
+
+	for _, image := range images {
+		if excluded[image] {
+			continue
+		}
+
+		id, err := r.ParseTag(image.Repository, image.Tag)
+		if err != nil {
+			return refs, err
+		}
+
+		if err := refs.Mark(r, id); err != nil {
+			if broken, ok := err.(BrokenImageError); ok {
+				return refs, fmt.Errorf("Tag %s:%s is broken, %v. Push it again or remove the tag before removing images", image.Repository, image.Tag, broken)
+			}
+			return refs, err
+		}
+	}
+
+	return refs, nil
+}
+
+// An image in a chain that's missing files, without a json to tell its parent.
+// Whatever its ancestors are, they can't be marked.
+type BrokenImageError struct {
+	ID ID
+}
+
+func (e BrokenImageError) Error() string {
+	return fmt.Sprintf("image %s is incomplete and has no json to find its parent in", e.ID.Short())
+}
+
+// Mark the chain of images starting at id. An incomplete image is marked
+// along with its ancestors as long as its json is there, pushing it again
+// repairs it. Fails with BrokenImageError otherwise.
+func (refs References) Mark(r Remote, id ID) error {
+	return r.WalkImages(id, func(id ID, image docker.Image, err error) error {
+		if err == ErrNoSuchImage {
+			if refs.Images[ID(id.String())] {
+				return BreakWalk
+			}
+
+			parent, err := incompleteParent(r, id)
+			if err != nil {
+				return err
+			}
+
+			refs.Images[ID(id.String())] = true
+			if err := refs.Mark(r, parent); err != nil {
+				return err
+			}
+			return BreakWalk
+		} else if err != nil {
+			return err
+		}
+
+		id = ID(id.String())
+
+		// the rest of the chain was marked already
+		if refs.Images[id] {
+			return BreakWalk
+		}
+		refs.Images[id] = true
+
+		layers, err := r.ImageLayers(id)
+		if err != nil {
+			return err
+		}
+
+		for _, layer := range layers {
+			refs.Layers[layer] = true
+		}
+
+		return nil
+	})
+}
+
+// the parent in the json of an image missing some of its other files
+func incompleteParent(r Remote, id ID) (ID, error) {
+	reader, err := r.OpenKey(ImagePrefix(id) + "json")
+	if err != nil {
+		return "", BrokenImageError{id}
+	}
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+
+	image, err := parseImageJson(data)
+	if err != nil {
+		return "", BrokenImageError{id}
+	}
+
+	return ID(image.Parent), nil
+}
+
+// UnreferencedGarbage returns the images in the chain starting at id, and
+// their layers, that refs doesn't reach. The walk stops at the first image
+// still in use since its ancestors are in use too.
+func UnreferencedGarbage(r Remote, id ID, refs References) ([]Garbage, error) {
+	garbage := make([]Garbage, 0)
+	seenLayers := make(map[ID]bool)
+
+	err := r.WalkImages(id, func(id ID, image docker.Image, err error) error {
+		if err == ErrNoSuchImage {
+			return BreakWalk
+		} else if err != nil {
+			return err
+		}
+
+		id = ID(id.String())
+
+		if refs.Images[id] {
+			return BreakWalk
+		}
+
+		layers, err := r.ImageLayers(id)
+		if err != nil {
+			return err
+		}
+
+		for _, layer := range layers {
+			if refs.Layers[layer] || seenLayers[layer] {
+				continue
+			}
+			seenLayers[layer] = true
+
+			layerGarbage, err := garbageAt(r, LayerPrefix(layer))
+			if err != nil {
+				return err
+			}
+			garbage = append(garbage, layerGarbage)
+		}
+
+		imageGarbage, err := garbageAt(r, ImagePrefix(id))
+		if err != nil {
+			return err
+		}
+		garbage = append(garbage, imageGarbage)
+
+		return nil
+	})
+
+	return garbage, err
+}
+
+// the keys below prefix, as one piece of garbage
+func garbageAt(r Remote, prefix string) (Garbage, error) {
+	g := Garbage{Prefix: prefix}
+
+	keyInfos, err := r.ListKeys(prefix)
+	if err != nil {
+		return g, err
+	}
+
+	for _, keyInfo := range keyInfos {
+		g.add(keyInfo)
+	}
+
+	return g, nil
+}
+
+// The keys of one unreferenced image or layer
+type Garbage struct {
+	Prefix       string
+	Keys         []string
+	Size         int64
+	LastModified time.Time
+}
+
+func (g *Garbage) add(keyInfo KeyInfo) {
+	g.Keys = append(g.Keys, keyInfo.Key)
+	g.Size += keyInfo.Size
+	if keyInfo.LastModified.After(g.LastModified) {
+		g.LastModified = keyInfo.LastModified
+	}
+}
+
+// FindGarbage returns the images and layers on the remote that refs doesn't
+// reach. Anything modified after olderThan is left alone, since it may belong
+// to a push that hasn't written its tag yet.
+func FindGarbage(r Remote, refs References, olderThan time.Time) ([]Garbage, error) {
+	garbage := make([]Garbage, 0)
+
+	for _, base := range []string{"images/", "layers/"} {
+		keyInfos, err := r.ListKeys(base)
+		if err != nil {
+			return nil, err
+		}
+
+		groups := make(map[string]*Garbage)
+		prefixes := make([]string, 0)
+
+		for _, keyInfo := range keyInfos {
+			parts := strings.SplitN(strings.TrimPrefix(keyInfo.Key, base), "/", 2)
+			if len(parts) < 2 {
+				continue
+			}
+
+			id := ID(parts[0])
+			if (base == "images/" && refs.Images[id]) || (base == "layers/" && refs.Layers[id]) {
+				continue
+			}
+
+			prefix := base + parts[0] + "/"
+			group, ok := groups[prefix]
+			if !ok {
+				group = &Garbage{Prefix: prefix}
+				groups[prefix] = group
+				prefixes = append(prefixes, prefix)
+			}
+
+			group.add(keyInfo)
+		}
+
+		sort.Strings(prefixes)
+		for _, prefix := range prefixes {
+			garbage = append(garbage, *groups[prefix])
+		}
+	}
+
+	return OlderThan(garbage, olderThan), nil
+}
+
+// OlderThan returns the garbage last modified at or before olderThan. Newer
+// files may belong to a push that hasn't written its tag yet.
+func OlderThan(garbage []Garbage, olderThan time.Time) []Garbage {
+	old := make([]Garbage, 0, len(garbage))
+
+	for _, g := range garbage {
+		if !g.LastModified.After(olderThan) {
+			old = append(old, g)
+		}
+	}
+
+	return old
+}
+
+// Unreferenced returns the garbage that refs doesn't reach. Marking again
+// right before removing keeps what was tagged since the garbage was found.
+func Unreferenced(garbage []Garbage, refs References) []Garbage {
+	unreferenced := make([]Garbage, 0, len(garbage))
+
+	for _, g := range garbage {
+		parts := strings.SplitN(g.Prefix, "/", 3)
+		if len(parts) < 2 {
+			continue
+		}
+
+		id := ID(parts[1])
+		if (parts[0] == "images" && refs.Images[id]) || (parts[0] == "layers" && refs.Layers[id]) {
+			continue
+		}
+
+		unreferenced = append(unreferenced, g)
+	}
+
+	return unreferenced
+}
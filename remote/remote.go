@@ -1,8 +1,16 @@
 package remote
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/dogestry/dogestry/config"
 	docker "github.com/fsouza/go-dockerclient"
@@ -14,6 +22,9 @@ var (
 	ErrNoSuchImage = errors.New("No such image")
 	ErrNoSuchTag   = errors.New("No such tag")
 	BreakWalk      = errors.New("break walk")
+
+	ErrDigestMismatch = errors.New("Digest mismatch")
+	ErrMissingFile    = errors.New("Missing file")
 )
 
 type Image struct {
@@ -21,6 +32,93 @@ type Image struct {
 	Tag        string
 }
 
+// A file on the remote
+type KeyInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// key of the tag file for repo:tag, relative to the remote
+func TagKey(repo, tag string) string {
+	return path.Join("repositories", repo, tag)
+}
+
+// prefix of all keys of an image, relative to the remote
+func ImagePrefix(id ID) string {
+	return "images/" + id.String() + "/"
+}
+
+// prefix of all keys of a content addressed layer, relative to the remote
+func LayerPrefix(digest ID) string {
+	return "layers/" + digest.String() + "/"
+}
+
+// Image config as saved by Docker 1.10+ (<config digest>.json in `docker save`).
+// Only the parts dogestry needs are decoded.
+type ImageConfig struct {
+	RootFS struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// ParseImageConfig decodes a Docker 1.10+ image config.
+func ParseImageConfig(data []byte) (ImageConfig, error) {
+	var config ImageConfig
+	err := json.Unmarshal(data, &config)
+	return config, err
+}
+
+// Layers returns the diff IDs of the image, which are the sha256 digests of
+// the uncompressed layer tarballs, base layer first.
+func (config ImageConfig) Layers() []ID {
+	layers := make([]ID, 0, len(config.RootFS.DiffIDs))
+	for _, diffId := range config.RootFS.DiffIDs {
+		layers = append(layers, ID(diffId).trimPrefix())
+	}
+	return layers
+}
+
+// Image metadata from a Docker 1.10+ image config. Configs carry no id or
+// parent, so the image always ends the walk.
+func imageFromConfig(id ID, data []byte) (docker.Image, error) {
+	image, err := parseImageJson(data)
+	if err != nil {
+		return image, err
+	}
+	image.ID = id.String()
+	image.Parent = ""
+	return image, nil
+}
+
+// parseImageJson decodes image metadata as stored by docker save. The
+// snake_case keys don't match the docker.Image field names, so those are
+// decoded separately.
+func parseImageJson(data []byte) (docker.Image, error) {
+	image := docker.Image{}
+	if err := json.Unmarshal(data, &image); err != nil {
+		return image, err
+	}
+
+	saved := struct {
+		ContainerConfig *docker.Config `json:"container_config"`
+		DockerVersion   string         `json:"docker_version"`
+	}{}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return image, err
+	}
+
+	if saved.ContainerConfig != nil {
+		image.ContainerConfig = *saved.ContainerConfig
+	}
+	if saved.DockerVersion != "" {
+		image.DockerVersion = saved.DockerVersion
+	}
+
+	return image, nil
+}
+
 type ImageWalkFn func(id ID, image docker.Image, err error) error
 
 type Remote interface {
@@ -40,6 +138,16 @@ type Remote interface {
 
 	ImageMetadata(id ID) (docker.Image, error)
 
+	// content addressed layers of a Docker 1.10+ image, base layer first.
+	// Legacy images (and images without a stored config) have no layers.
+	ImageLayers(id ID) ([]ID, error)
+
+	// checks whether a content addressed layer exists on the remote
+	LayerExists(digest ID) (bool, error)
+
+	// pull a single content addressed layer from the remote
+	PullLayer(digest ID, dst string) error
+
 	// return repo, tag from a file path (or S3 key)
 	ParseImagePath(path string, prefix string) (repo, tag string)
 
@@ -54,10 +162,47 @@ type Remote interface {
 
 	// List images on the remote
 	List() ([]Image, error)
+
+	// list the files on the remote whose key starts with prefix.
+	// Keys are relative to the remote, eg "images/123/json".
+	ListKeys(prefix string) ([]KeyInfo, error)
+
+	// remove files from the remote
+	RemoveKeys(keys []string) error
+
+	// open a file on the remote for reading
+	OpenKey(key string) (io.ReadCloser, error)
+}
+
+// Implemented by remotes that files can be pushed to as they're read, without
+// staging them on disk first.
+type StreamingRemote interface {
+	Remote
+
+	// write size bytes read from reader to key, and their sha256 digest to
+	// key.sum. Fails with ErrDigestMismatch if sum is given and doesn't match.
+	PushStream(key string, reader io.Reader, size int64, sum string) error
 }
 
+// NewRemote picks a Remote implementation based on the scheme of the remote
+// URL: "s3://" for S3, "file://" or a bare path for the local filesystem.
 func NewRemote(config config.Config) (Remote, error) {
-	remote, err := NewS3Remote(config)
+	var remote Remote
+	var err error
+
+	if config.AWS.S3URL == nil {
+		return nil, ErrInvalidRemote
+	}
+
+	switch config.AWS.S3URL.Scheme {
+	case "s3":
+		remote, err = NewS3Remote(config)
+	case "file", "":
+		remote, err = NewLocalRemote(config)
+	default:
+		return nil, fmt.Errorf("%v: unsupported scheme '%s'", ErrInvalidRemote, config.AWS.S3URL.Scheme)
+	}
+
 	if err != nil {
 		return nil, err
 	}
@@ -70,6 +215,27 @@ func NewRemote(config config.Config) (Remote, error) {
 	return remote, nil
 }
 
+// WriteTag points repo:tag on the remote at id. The tag file is staged in
+// workDir and pushed like any other file.
+func WriteTag(r Remote, repo, tag string, id ID, workDir string) error {
+	stage, err := ioutil.TempDir(workDir, "tag")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stage)
+
+	tagFile := filepath.Join(stage, filepath.FromSlash(TagKey(repo, tag)))
+	if err := os.MkdirAll(filepath.Dir(tagFile), os.ModeDir|0700); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(tagFile, []byte(id), 0600); err != nil {
+		return err
+	}
+
+	return r.Push(repo+":"+tag, stage)
+}
+
 func NormaliseImageName(image string) (string, string) {
 	repoParts := strings.Split(image, ":")
 	if len(repoParts) == 1 {
@@ -99,6 +265,53 @@ func ResolveImageNameToId(remote Remote, image string) (ID, error) {
 	return "", ErrNoSuchImage
 }
 
+// ImageSize adds up the size of the files stored for the chain of images
+// starting at id, counting each layer once. Sum files aren't counted.
+func ImageSize(r Remote, id ID) (int64, error) {
+	var size int64
+	seenLayers := make(map[ID]bool)
+
+	err := r.WalkImages(id, func(id ID, image docker.Image, err error) error {
+		// dangling tag or parent, count what's there
+		if err == ErrNoSuchImage {
+			return BreakWalk
+		} else if err != nil {
+			return err
+		}
+
+		prefixes := []string{ImagePrefix(id)}
+
+		layers, err := r.ImageLayers(id)
+		if err != nil {
+			return err
+		}
+
+		for _, layer := range layers {
+			if !seenLayers[layer] {
+				seenLayers[layer] = true
+				prefixes = append(prefixes, LayerPrefix(layer))
+			}
+		}
+
+		for _, prefix := range prefixes {
+			keyInfos, err := r.ListKeys(prefix)
+			if err != nil {
+				return err
+			}
+
+			for _, keyInfo := range keyInfos {
+				if !strings.HasSuffix(keyInfo.Key, ".sum") {
+					size += keyInfo.Size
+				}
+			}
+		}
+
+		return nil
+	})
+
+	return size, err
+}
+
 func ParseImagePath(path string, prefix string) (repo, tag string) {
 	path = strings.TrimPrefix(path, prefix)
 	parts := strings.Split(path, "/")
@@ -120,12 +333,16 @@ func WalkImages(remote Remote, id ID, walker ImageWalkFn) error {
 	}
 
 	img, err := remote.ImageMetadata(id)
-	// image wasn't found
-	if err != nil {
-		return walker(id, docker.Image{}, err)
+	// image wasn't found, the walker decides whether that's an error
+	if err == nil {
+		err = walker(id, img, nil)
+	} else {
+		err = walker(id, docker.Image{}, err)
+		if err == nil {
+			return nil
+		}
 	}
 
-	err = walker(id, img, nil)
 	if err != nil {
 		// abort the walk
 		if err == BreakWalk {
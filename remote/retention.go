@@ -0,0 +1,197 @@
+package remote
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Retention policy for the tags on a remote, eg:
+//
+//   {"rules": [
+//     {"repositories": ["myapp"], "keep_last": 10, "protect": ["latest", "release-*"]},
+//     {"max_age": "30d"}
+//   ]}
+//
+// Each repository is handled by the first rule matching it, repositories no
+// rule matches are left alone.
+type RetentionPolicy struct {
+	Rules []RetentionRule `json:"rules"`
+}
+
+type RetentionRule struct {
+	// glob patterns (see path.Match) of the repositories the rule applies
+	// to, all repositories if empty
+	Repositories []string `json:"repositories"`
+
+	// keep the newest KeepLast tags of each repository, 0 for no limit
+	KeepLast int `json:"keep_last"`
+
+	// remove tags older than MaxAge, eg "720h" or "30d". Empty for no limit
+	MaxAge Duration `json:"max_age"`
+
+	// glob patterns of tags that are never removed. Protected tags don't
+	// count towards KeepLast
+	Protect []string `json:"protect"`
+}
+
+// time.Duration that unmarshals from strings like "36h" or "30d"
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	if s == "" {
+		d.Duration = 0
+		return nil
+	}
+
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", s)
+		}
+		d.Duration = time.Duration(days) * 24 * time.Hour
+		return nil
+	}
+
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+// A tag on the remote, with the time its tag file was last written
+type TagInfo struct {
+	Image
+	LastModified time.Time
+}
+
+func LoadRetentionPolicy(file string) (RetentionPolicy, error) {
+	policy := RetentionPolicy{}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return policy, err
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(&policy); err != nil {
+		return policy, fmt.Errorf("unable to parse retention policy %s: %v", file, err)
+	}
+
+	// catch bad patterns now rather than halfway through a prune
+	for _, rule := range policy.Rules {
+		patterns := make([]string, 0, len(rule.Repositories)+len(rule.Protect))
+		patterns = append(append(patterns, rule.Repositories...), rule.Protect...)
+
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return policy, fmt.Errorf("invalid pattern %q in retention policy %s: %v", pattern, file, err)
+			}
+		}
+	}
+
+	return policy, nil
+}
+
+// ListTags lists the tags on the remote with their modification times
+func ListTags(r Remote) ([]TagInfo, error) {
+	keyInfos, err := r.ListKeys("repositories/")
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make([]TagInfo, 0, len(keyInfos))
+	for _, keyInfo := range keyInfos {
+		if strings.HasSuffix(keyInfo.Key, ".sum") {
+			continue
+		}
+
+		repo, tag := r.ParseImagePath(keyInfo.Key, "repositories/")
+		tags = append(tags, TagInfo{Image{repo, tag}, keyInfo.LastModified})
+	}
+
+	return tags, nil
+}
+
+// Expired returns the tags the policy removes as of now
+func (policy RetentionPolicy) Expired(tags []TagInfo, now time.Time) []TagInfo {
+	byRepo := make(map[string][]TagInfo)
+	for _, tag := range tags {
+		byRepo[tag.Repository] = append(byRepo[tag.Repository], tag)
+	}
+
+	repos := make([]string, 0, len(byRepo))
+	for repo := range byRepo {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+
+	expired := make([]TagInfo, 0)
+
+	for _, repo := range repos {
+		rule, ok := policy.ruleFor(repo)
+		if !ok {
+			continue
+		}
+
+		repoTags := byRepo[repo]
+		sort.Sort(newestFirst(repoTags))
+
+		kept := 0
+		for _, tag := range repoTags {
+			if matchAny(rule.Protect, tag.Tag) {
+				continue
+			}
+
+			tooMany := rule.KeepLast > 0 && kept >= rule.KeepLast
+			tooOld := rule.MaxAge.Duration > 0 && now.Sub(tag.LastModified) > rule.MaxAge.Duration
+
+			if tooMany || tooOld {
+				expired = append(expired, tag)
+			} else {
+				kept++
+			}
+		}
+	}
+
+	return expired
+}
+
+// the first rule matching repo
+func (policy RetentionPolicy) ruleFor(repo string) (RetentionRule, bool) {
+	for _, rule := range policy.Rules {
+		if len(rule.Repositories) == 0 || matchAny(rule.Repositories, repo) {
+			return rule, true
+		}
+	}
+	return RetentionRule{}, false
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+type newestFirst []TagInfo
+
+func (t newestFirst) Len() int           { return len(t) }
+func (t newestFirst) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t newestFirst) Less(i, j int) bool { return t[i].LastModified.After(t[j].LastModified) }
@@ -0,0 +1,79 @@
+package remote
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type RetentionS struct{}
+
+var _ = Suite(&RetentionS{})
+
+func tagsAt(now time.Time, repo string, ages map[string]time.Duration) []TagInfo {
+	tags := make([]TagInfo, 0)
+	for tag, age := range ages {
+		tags = append(tags, TagInfo{Image{repo, tag}, now.Add(-age)})
+	}
+	return tags
+}
+
+func expiredNames(expired []TagInfo) []string {
+	names := make([]string, 0)
+	for _, tag := range expired {
+		names = append(names, tag.Repository+":"+tag.Tag)
+	}
+	return names
+}
+
+func (s *RetentionS) TestKeepLast(c *C) {
+	now := time.Now()
+	tags := tagsAt(now, "myapp", map[string]time.Duration{
+		"latest":    0,
+		"build-4":   time.Hour,
+		"build-3":   2 * time.Hour,
+		"release-1": 3 * time.Hour,
+		"build-2":   4 * time.Hour,
+		"build-1":   5 * time.Hour,
+	})
+
+	policy := RetentionPolicy{Rules: []RetentionRule{
+		{KeepLast: 2, Protect: []string{"latest", "release-*"}},
+	}}
+
+	c.Assert(expiredNames(policy.Expired(tags, now)), DeepEquals, []string{"myapp:build-2", "myapp:build-1"})
+}
+
+func (s *RetentionS) TestMaxAgeAndFirstMatchingRule(c *C) {
+	now := time.Now()
+	tags := append(
+		tagsAt(now, "myapp", map[string]time.Duration{"new": time.Hour, "old": 72 * time.Hour}),
+		tagsAt(now, "team/tool", map[string]time.Duration{"old": 72 * time.Hour})...,
+	)
+
+	policy := RetentionPolicy{Rules: []RetentionRule{
+		{Repositories: []string{"team/*"}, KeepLast: 5},
+		{MaxAge: Duration{48 * time.Hour}},
+	}}
+
+	c.Assert(expiredNames(policy.Expired(tags, now)), DeepEquals, []string{"myapp:old"})
+}
+
+func (s *RetentionS) TestLoadRetentionPolicy(c *C) {
+	dir := c.MkDir()
+
+	file := filepath.Join(dir, "policy.json")
+	ioutil.WriteFile(file, []byte(`{"rules": [{"repositories": ["myapp"], "keep_last": 3, "max_age": "30d", "protect": ["latest"]}]}`), 0600)
+
+	policy, err := LoadRetentionPolicy(file)
+	c.Assert(err, IsNil)
+	c.Assert(policy.Rules, HasLen, 1)
+	c.Assert(policy.Rules[0].KeepLast, Equals, 3)
+	c.Assert(policy.Rules[0].MaxAge.Duration, Equals, 30*24*time.Hour)
+
+	ioutil.WriteFile(file, []byte(`{"rules": [{"protect": ["[latest"]}]}`), 0600)
+	_, err = LoadRetentionPolicy(file)
+	c.Assert(err, ErrorMatches, "invalid pattern .*")
+}
@@ -0,0 +1,121 @@
+package remote
+
+import (
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/crowdmob/goamz/s3"
+	"github.com/dogestry/dogestry/config"
+	"github.com/rlmcpherson/s3gof3r"
+)
+
+// How often, and how patiently, a failed call to S3 is tried again
+type RetryPolicy struct {
+	// attempts including the first one, 1 never retries
+	Attempts int
+
+	// delay before the first retry, doubled before each one after
+	BaseDelay time.Duration
+
+	// longest delay between attempts
+	MaxDelay time.Duration
+}
+
+const DefaultMaxRetryDelay = 30 * time.Second
+
+// RetryPolicyFromConfig builds the policy set by the -retries and
+// -retry-delay flags.
+func RetryPolicyFromConfig(cfg config.Config) RetryPolicy {
+	policy := RetryPolicy{
+		Attempts:  cfg.RetryAttempts,
+		BaseDelay: cfg.RetryDelay,
+		MaxDelay:  DefaultMaxRetryDelay,
+	}
+
+	if policy.Attempts < 1 {
+		policy.Attempts = config.DefaultRetryAttempts
+	}
+	if policy.BaseDelay <= 0 {
+		policy.BaseDelay = config.DefaultRetryDelay
+	}
+
+	return policy
+}
+
+// Do calls fn until it succeeds, fails with an error that isn't worth
+// retrying, or runs out of attempts. desc describes the call in the log.
+func (policy RetryPolicy) Do(desc string, fn func() error) error {
+	var err error
+
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil || !IsRetryable(err) || attempt >= policy.Attempts {
+			return err
+		}
+
+		delay := policy.Delay(attempt)
+		log.Printf("%s failed (attempt %d/%d), retrying in %v: %v", desc, attempt, policy.Attempts, delay, err)
+		time.Sleep(delay)
+	}
+}
+
+// Delay before retrying after the given attempt: exponential backoff with
+// jitter, so that concurrent uploaders being throttled don't all retry at
+// the same moment.
+func (policy RetryPolicy) Delay(attempt int) time.Duration {
+	delay := policy.BaseDelay
+	for i := 1; i < attempt && delay < policy.MaxDelay; i++ {
+		delay *= 2
+	}
+
+	if policy.MaxDelay > 0 && delay > policy.MaxDelay {
+		delay = policy.MaxDelay
+	}
+
+	// somewhere between half and all of it
+	half := int64(delay / 2)
+	if half <= 0 {
+		return delay
+	}
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// IsRetryable tells apart errors that may go away when tried again (server
+// errors, throttling, dropped connections, corrupt downloads) from those
+// that won't (missing keys, access denied, local errors).
+func IsRetryable(err error) bool {
+	switch err {
+	case nil:
+		return false
+	case io.EOF, io.ErrUnexpectedEOF, ErrDigestMismatch:
+		return true
+	}
+
+	switch e := err.(type) {
+	case *s3.Error:
+		return retryableResponse(e.StatusCode, e.Code)
+	case *s3gof3r.RespError:
+		return retryableResponse(e.StatusCode, e.Code)
+	case *url.Error:
+		return true
+	case net.Error:
+		return true
+	}
+
+	// downloads report which key was corrupt
+	return strings.HasPrefix(err.Error(), ErrDigestMismatch.Error())
+}
+
+func retryableResponse(statusCode int, code string) bool {
+	switch code {
+	case "SlowDown", "RequestTimeout", "InternalError", "ServiceUnavailable":
+		return true
+	}
+
+	return statusCode >= 500 || statusCode == 429
+}
@@ -0,0 +1,104 @@
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/crowdmob/goamz/s3"
+	"github.com/rlmcpherson/s3gof3r"
+	. "gopkg.in/check.v1"
+)
+
+type RetryS struct{}
+
+var _ = Suite(&RetryS{})
+
+func quickPolicy(attempts int) RetryPolicy {
+	return RetryPolicy{Attempts: attempts, BaseDelay: time.Millisecond, MaxDelay: 4 * time.Millisecond}
+}
+
+func (s *RetryS) TestRetriesUntilSuccess(c *C) {
+	calls := 0
+	err := quickPolicy(5).Do("test", func() error {
+		calls++
+		if calls < 3 {
+			return &s3.Error{StatusCode: 503, Code: "SlowDown"}
+		}
+		return nil
+	})
+
+	c.Assert(err, IsNil)
+	c.Assert(calls, Equals, 3)
+}
+
+func (s *RetryS) TestGivesUpAfterAttempts(c *C) {
+	calls := 0
+	err := quickPolicy(3).Do("test", func() error {
+		calls++
+		return io.ErrUnexpectedEOF
+	})
+
+	c.Assert(err, Equals, io.ErrUnexpectedEOF)
+	c.Assert(calls, Equals, 3)
+}
+
+func (s *RetryS) TestDoesNotRetryPermanentErrors(c *C) {
+	calls := 0
+	notFound := &s3.Error{StatusCode: 404, Code: "NoSuchKey"}
+	err := quickPolicy(5).Do("test", func() error {
+		calls++
+		return notFound
+	})
+
+	c.Assert(err, Equals, notFound)
+	c.Assert(calls, Equals, 1)
+}
+
+func (s *RetryS) TestDelayBacksOff(c *C) {
+	policy := RetryPolicy{Attempts: 10, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+
+	for attempt, max := range map[int]time.Duration{
+		1: 100 * time.Millisecond,
+		2: 200 * time.Millisecond,
+		3: 400 * time.Millisecond,
+		4: 800 * time.Millisecond,
+		5: time.Second,
+		9: time.Second,
+	} {
+		delay := policy.Delay(attempt)
+		c.Assert(delay >= max/2 && delay <= max, Equals, true, Commentf("attempt %d: %v", attempt, delay))
+	}
+}
+
+func (s *RetryS) TestIsRetryable(c *C) {
+	retryable := []error{
+		io.EOF,
+		io.ErrUnexpectedEOF,
+		ErrDigestMismatch,
+		fmt.Errorf("%v: %s", ErrDigestMismatch, "images/123/layer.tar"),
+		&s3.Error{StatusCode: 500, Code: "InternalError"},
+		&s3.Error{StatusCode: 503},
+		&s3.Error{StatusCode: 400, Code: "RequestTimeout"},
+		&s3gof3r.RespError{StatusCode: 503, Code: "SlowDown"},
+		&url.Error{Op: "Get", URL: "https://bucket.s3.amazonaws.com/", Err: errors.New("connection reset by peer")},
+	}
+	for _, err := range retryable {
+		c.Assert(IsRetryable(err), Equals, true, Commentf("%#v", err))
+	}
+
+	permanent := []error{
+		nil,
+		ErrNoSuchImage,
+		&s3.Error{StatusCode: 404, Code: "NoSuchKey"},
+		&s3.Error{StatusCode: 403, Code: "AccessDenied"},
+		&s3gof3r.RespError{StatusCode: 403, Code: "AccessDenied"},
+		&os.PathError{Op: "open", Path: "/nonexistent", Err: os.ErrNotExist},
+	}
+	for _, err := range permanent {
+		c.Assert(IsRetryable(err), Equals, false, Commentf("%#v", err))
+	}
+}
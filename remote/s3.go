@@ -1,14 +1,19 @@
 package remote
 
 import (
-	"encoding/json"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log"
+	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -21,20 +26,10 @@ import (
 )
 
 const (
-	MaxGetFileAttempts int = 3
-	PushNumGoroutines      = 25
+	PushNumGoroutines int = 25
+	MaxDeleteKeys         = 1000 // S3 limit per multi-object delete
 )
 
-type putFileResult struct {
-	host string
-	err  error
-}
-
-type putConfig struct {
-	resultChan         chan putFileResult
-	putFilesChan       <-chan putFileTuple
-}
-
 func NewS3Remote(config config.Config) (*S3Remote, error) {
 	s3, err := newS3Client(config)
 	if err != nil {
@@ -46,12 +41,15 @@ func NewS3Remote(config config.Config) (*S3Remote, error) {
 		return nil, err
 	}
 
-	return &S3Remote{
+	remote := &S3Remote{
 		config:               config,
 		BucketName:           config.AWS.S3URL.Host,
 		client:               s3,
 		uploadDownloadClient: udClient,
-	}, nil
+	}
+	remote.transfers = utils.NewLimiter(remote.concurrency())
+
+	return remote, nil
 }
 
 type S3Remote struct {
@@ -60,6 +58,9 @@ type S3Remote struct {
 	Bucket               *s3.Bucket
 	client               *s3.S3
 	uploadDownloadClient *s3gof3r.S3
+
+	// every file pushed or pulled, whichever pool it's from
+	transfers utils.Limiter
 }
 
 var (
@@ -108,9 +109,7 @@ func getS3gof3rKeys(config config.Config) (s3gof3r.Keys, error) {
 }
 
 func (remote *S3Remote) Validate() error {
-	bucket := remote.getBucket()
-
-	_, err := bucket.List("", "", "", 1)
+	_, err := remote.listObjects("", "", "", 1)
 	if err != nil {
 		return fmt.Errorf("%s unable to ping s3 bucket: %s", remote.Desc(), err)
 	}
@@ -120,83 +119,53 @@ func (remote *S3Remote) Validate() error {
 
 // Remote: describe the remote
 func (remote *S3Remote) Desc() string {
+	if prefix := remote.prefix(); prefix != "" {
+		return fmt.Sprintf("s3(bucket=%s, prefix=%s, region=%s)", remote.BucketName, prefix, remote.client.Region.Name)
+	}
 	return fmt.Sprintf("s3(bucket=%s, region=%s)", remote.BucketName, remote.client.Region.Name)
 }
 
-type putFileTuple struct {
-	Key    string
-	KeyDef keyDef
-}
-
-func makeFilesChan(keysToPush keys) <-chan putFileTuple {
-	putFilesChan := make(chan putFileTuple, len(keysToPush))
-	go func() {
-		defer close(putFilesChan)
-		for key, localKey := range keysToPush {
-			keyDefClone := *localKey
-			putFilesChan <- putFileTuple{key, keyDefClone}
-		}
-	}()
-	return putFilesChan
-}
-
-func (remote *S3Remote) pushLayers(i int, putConf putConfig) {
-	go func(i int) {
-		for putFile := range putConf.putFilesChan {
-			putFileErr := remote.putFile(putFile.KeyDef.fullPath, &putFile.KeyDef)
-
-			if (putFileErr != nil) && ((putFileErr != io.EOF) && (!strings.Contains(putFileErr.Error(), "EOF"))) {
-				putConf.resultChan <- putFileResult{putFile.Key, putFileErr}
-				return
-			}
-
-			putConf.resultChan <- putFileResult{}
-		}
-	}(i)
-}
-
 func (remote *S3Remote) Push(image, imageRoot string) error {
 	var err error
 
-	keysToPush, err := remote.localKeys(imageRoot)
+	localKeys, err := remote.localKeys(imageRoot)
 	if err != nil {
 		return fmt.Errorf("error calculating keys to push: %v", err)
 	}
 
+	keysToPush, err := remote.changedKeys(localKeys)
+	if err != nil {
+		return fmt.Errorf("error comparing keys to push: %v", err)
+	}
+
+	if skipped := len(localKeys) - len(keysToPush); skipped > 0 {
+		log.Printf("Skipping %d unchanged files (%s)", skipped, utils.HumanSize(localKeys.size()-keysToPush.size()))
+	}
+
 	if len(keysToPush) == 0 {
 		log.Println("There are no files to push")
 		return nil
 	}
 
-	putConf := putConfig{
-		resultChan:   make(chan putFileResult, PushNumGoroutines),
-		putFilesChan: makeFilesChan(keysToPush),
+	names := make([]string, 0, len(keysToPush))
+	for key := range keysToPush {
+		names = append(names, key)
 	}
+	sort.Strings(names)
 
-	defer close(putConf.resultChan) // Pusher goroutines exit when we do this
-
-	// Spin up PushNumGoroutines number of uploaders
 	println("Pushing files to S3 remote:")
-	for i := 0; i < PushNumGoroutines; i++ {
-		go remote.pushLayers(i, putConf)
-	}
-
-	// See if we had any errors, if so end immediately.
-	// This will eventually time out in the S3 library
-	// and report errors so we don't need to ourselves.
-	for i := 0; i < len(keysToPush); i++ {
-		p := <-putConf.resultChan
-		if p.err != nil {
-			err = p.err
-			break
-		}
-	}
+	errMap := utils.Parallel(remote.concurrency(), names, func(name string) error {
+		key := *keysToPush[name]
+		return remote.transfers.Run(func() error {
+			return remote.retry("Push of "+key.key, func() error {
+				return remote.putFile(key.fullPath, &key)
+			})
+		})
+	})
 
-	if err != nil {
-		log.Printf("error when uploading to S3: %v", err)
-		// Existing pushers will still finish here, exit on channel close
-		// which was deferred above.
-		return fmt.Errorf("Error when uploading to S3: %v", err)
+	if len(errMap) > 0 {
+		log.Printf("error when uploading to S3: %v", errMap)
+		return fmt.Errorf("Error when uploading %d of %d files to S3: %v", len(errMap), len(keysToPush), errMap)
 	}
 
 	return nil
@@ -212,10 +181,43 @@ func (remote *S3Remote) PullImageId(id ID, dst string) error {
 	return remote.getFiles(dst, rootKey, imageKeys)
 }
 
-func (remote *S3Remote) ParseTag(repo, tag string) (ID, error) {
-	bucket := remote.getBucket()
+func (remote *S3Remote) PullLayer(digest ID, dst string) error {
+	rootKey := "layers/" + digest.String()
+	layerKeys, err := remote.repoKeys("/" + rootKey)
+	if err != nil {
+		return err
+	}
+
+	if len(layerKeys) == 0 {
+		return ErrNoSuchImage
+	}
+
+	return remote.getFiles(dst, rootKey, layerKeys)
+}
+
+func (remote *S3Remote) LayerExists(digest ID) (bool, error) {
+	return remote.objectExists(path.Join(remote.layerPath(digest), "layer.tar"))
+}
+
+func (remote *S3Remote) ImageLayers(id ID) ([]ID, error) {
+	configJson, err := remote.getObject(path.Join(remote.imagePath(id), "config.json"))
+	if s3err, ok := err.(*s3.Error); ok && s3err.StatusCode == 404 {
+		// legacy image
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	config, err := ParseImageConfig(configJson)
+	if err != nil {
+		return nil, err
+	}
+
+	return config.Layers(), nil
+}
 
-	file, err := bucket.Get(remote.tagFilePath(repo, tag))
+func (remote *S3Remote) ParseTag(repo, tag string) (ID, error) {
+	file, err := remote.getObject(remote.tagFilePath(repo, tag))
 	if s3err, ok := err.(*s3.Error); ok && s3err.StatusCode == 404 {
 		// doesn't exist yet, deal with it
 		return "", nil
@@ -230,16 +232,18 @@ func (remote *S3Remote) ResolveImageNameToId(image string) (ID, error) {
 	return ResolveImageNameToId(remote, image)
 }
 
+// Uses a delimited listing so that only the image "directories" starting
+// with id are returned, rather than every file under images/.
 func (remote *S3Remote) ImageFullId(id ID) (ID, error) {
-	remoteKeys, err := remote.repoKeys("/images")
+	_, imagePrefixes, err := remote.listAll(remote.imagePath(id), "/")
 	if err != nil {
 		return "", err
 	}
 
-	for key, _ := range remoteKeys {
-		key = strings.TrimPrefix(key, "images/")
+	for _, imagePrefix := range imagePrefixes {
+		key := strings.TrimPrefix(remote.relativeKey(imagePrefix), "images/")
 		parts := strings.Split(key, "/")
-		if strings.HasPrefix(parts[0], string(id)) {
+		if parts[0] != "" && strings.HasPrefix(parts[0], string(id)) {
 			return ID(parts[0]), nil
 		}
 	}
@@ -252,12 +256,19 @@ func (remote *S3Remote) WalkImages(id ID, walker ImageWalkFn) error {
 }
 
 func (remote *S3Remote) ImageMetadata(id ID) (docker.Image, error) {
-	bucket := remote.getBucket()
 	image := docker.Image{}
 
+	// Docker 1.10+ images only have a config, their layers are stored separately
+	configJson, err := remote.getObject(path.Join(remote.imagePath(id), "config.json"))
+	if err == nil {
+		return imageFromConfig(id, configJson)
+	} else if s3err, ok := err.(*s3.Error); !ok || s3err.StatusCode != 404 {
+		return image, err
+	}
+
 	files := []string{"json", "layer.tar", "VERSION"}
 	for i := 0; i < len(files); i++ {
-		exists, err := bucket.Exists(path.Join(remote.imagePath(id), files[i]))
+		exists, err := remote.objectExists(path.Join(remote.imagePath(id), files[i]))
 		if err != nil {
 			return image, err
 		}
@@ -268,7 +279,7 @@ func (remote *S3Remote) ImageMetadata(id ID) (docker.Image, error) {
 
 	jsonPath := path.Join(remote.imagePath(id), "json")
 
-	imageJson, err := bucket.Get(jsonPath)
+	imageJson, err := remote.getObject(jsonPath)
 	if s3err, ok := err.(*s3.Error); ok && s3err.StatusCode == 404 {
 		// doesn't exist yet, deal with it
 		return image, ErrNoSuchImage
@@ -276,11 +287,7 @@ func (remote *S3Remote) ImageMetadata(id ID) (docker.Image, error) {
 		return image, err
 	}
 
-	if err := json.Unmarshal(imageJson, &image); err != nil {
-		return image, err
-	}
-
-	return image, nil
+	return parseImageJson(imageJson)
 }
 
 func (remote *S3Remote) ParseImagePath(path string, prefix string) (repo, tag string) {
@@ -324,60 +331,79 @@ func (k keys) Get(key string, remote *S3Remote) *keyDef {
 
 // Returns keys either not existing in other,
 // or whose sum doesn't match.
-func (k keys) NotIn(other keys) keys {
+func (k keys) NotIn(other keys) (keys, error) {
 	notIn := make(keys)
 
 	for key, thisKeyDef := range k {
-		if otherKeyDef, ok := other[key]; !ok || otherKeyDef.Sum() != thisKeyDef.Sum() {
+		otherKeyDef, ok := other[key]
+		if !ok {
+			notIn[key] = thisKeyDef
+			continue
+		}
+
+		otherSum, err := otherKeyDef.Sum()
+		if err != nil {
+			return nil, err
+		}
+		thisSum, err := thisKeyDef.Sum()
+		if err != nil {
+			return nil, err
+		}
+
+		if otherSum != thisSum {
 			notIn[key] = thisKeyDef
 		}
 	}
 
-	return notIn
+	return notIn, nil
 }
 
-func (kd *keyDef) Sum() (sum string) {
-	if kd.sum != "" {
-		return kd.sum
+// total size of the local files
+func (k keys) size() int64 {
+	var size int64
+	for _, keyDef := range k {
+		if info, err := os.Stat(keyDef.fullPath); err == nil {
+			size += info.Size()
+		}
 	}
+	return size
+}
 
-	if kd.sumKey == "" {
-		return ""
+// The sha256 of the key, empty if it has no sum. Files pushed before sums
+// were written have none. A sum that's listed but can't be read is an error,
+// the file can't be verified.
+func (kd *keyDef) Sum() (string, error) {
+	if kd.sum != "" || kd.sumKey == "" {
+		return kd.sum, nil
 	}
 
-	// get sum!
-	// honestly there's not much we can do if we don't get the sum here
-	// maybe a panic??
-	bytesSum, err := kd.remote.getBucket().Get(kd.sumKey)
+	bytesSum, err := kd.remote.getObject(kd.sumKey)
 	if err != nil {
-		return ""
+		return "", fmt.Errorf("getting the sum of %s: %v", kd.key, err)
 	}
 
-	kd.sum = string(bytesSum)
+	kd.sum = strings.TrimSpace(string(bytesSum))
 
-	return kd.sum
+	return kd.sum, nil
 }
 
 // get repository keys from s3
 func (remote *S3Remote) repoKeys(prefix string) (keys, error) {
 	repoKeys := make(keys)
 
-	prefix = strings.Trim(prefix, "/")
-
-	bucket := remote.getBucket()
-
-	cnt, err := bucket.List(prefix, "", "", 1000)
+	prefix = remote.remoteKey(strings.Trim(prefix, "/"))
 
+	contents, _, err := remote.listAll(prefix, "")
 	if err != nil {
 		return repoKeys, fmt.Errorf("getting bucket contents at prefix '%s': %s", prefix, err)
 	}
 
-	for _, key := range cnt.Contents {
+	for _, key := range contents {
 		if key.Key == "" {
 			continue
 		}
 
-		plainKey := strings.TrimPrefix(key.Key, "/")
+		plainKey := remote.relativeKey(key.Key)
 
 		if strings.HasSuffix(plainKey, ".sum") {
 			plainKey = strings.TrimSuffix(plainKey, ".sum")
@@ -391,6 +417,37 @@ func (remote *S3Remote) repoKeys(prefix string) (keys, error) {
 	return repoKeys, nil
 }
 
+// Returns the local keys that are missing on the remote, or whose sum differs.
+// Only the directories holding local keys are listed.
+func (remote *S3Remote) changedKeys(localKeys keys) (keys, error) {
+	dirs := make([]string, 0)
+	seen := make(map[string]bool)
+	for key := range localKeys {
+		if dir := path.Dir(key); !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Strings(dirs)
+
+	remoteKeys := make(keys)
+	for _, dir := range dirs {
+		dirKeys, err := remote.repoKeys(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		for key, keyDef := range dirKeys {
+			// a sum without its file doesn't count
+			if keyDef.s3Key.Key != "" {
+				remoteKeys[key] = keyDef
+			}
+		}
+	}
+
+	return localKeys.NotIn(remoteKeys)
+}
+
 // Get repository keys from the local work dir.
 // Returned as a map of s3.Key's for ease of comparison.
 func (remote *S3Remote) localKeys(root string) (keys, error) {
@@ -401,11 +458,11 @@ func (remote *S3Remote) localKeys(root string) (keys, error) {
 	}
 
 	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-		if info.IsDir() {
+		if info.IsDir() || strings.HasSuffix(path, ".sum") {
 			return nil
 		}
 
-		sum, err := utils.Sha1File(path)
+		sum, err := utils.Sha256File(path)
 		if err != nil {
 			return err
 		}
@@ -458,9 +515,47 @@ func (remote *S3Remote) putFile(src string, key *keyDef) error {
 		return err
 	}
 
+	// the sum goes up once the file is complete
+	if key.sum != "" {
+		return remote.getBucket().Put(dstKey+".sum", []byte(key.sum), "text/plain", s3.Private, s3.Options{})
+	}
+
 	return nil
 }
 
+// PushStream uploads key in parts as it's read, so it never has to be
+// written to disk. A stream can't be read twice, so unlike Push a failed
+// upload isn't retried; it's removed rather than left incomplete.
+func (remote *S3Remote) PushStream(key string, reader io.Reader, size int64, sum string) error {
+	dstKey := remote.remoteKey(key)
+
+	w, err := remote.getUploadDownloadBucket().PutWriter(dstKey, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	progressReader := utils.NewProgressReader(reader, size, key)
+
+	_, err = io.Copy(w, io.TeeReader(progressReader, hash))
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+
+	digest := hex.EncodeToString(hash.Sum(nil))
+	if err == nil && sum != "" && sum != digest {
+		err = fmt.Errorf("%v: %s", ErrDigestMismatch, key)
+	}
+
+	if err != nil {
+		remote.deleteObjects([]s3.Object{{Key: dstKey}})
+		return err
+	}
+
+	// the sum goes up once the file is complete
+	return remote.putObject(dstKey+".sum", []byte(digest), "text/plain")
+}
+
 // get files from the s3 bucket to a local path, relative to rootKey
 // eg
 //
@@ -468,120 +563,378 @@ func (remote *S3Remote) putFile(src string, key *keyDef) error {
 // rootKey: "images/456"
 // key: "images/456/json"
 // downloads to: "/tmp/rego/123/456/json"
+//
+// Up to -concurrency files are downloaded at once, counting those of other
+// calls running at the same time.
 func (remote *S3Remote) getFiles(dst, rootKey string, imageKeys keys) error {
-	errMap := make(map[string]error)
+	names := make([]string, 0, len(imageKeys))
+	for name, key := range imageKeys {
+		// a sum without its file, nothing to download
+		if key.s3Key.Key != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	errMap := utils.Parallel(remote.concurrency(), names, func(name string) error {
+		key := imageKeys[name]
 
-	for _, key := range imageKeys {
 		relKey := strings.TrimPrefix(key.key, rootKey)
 		relKey = strings.TrimPrefix(relKey, "/")
 
-		if err := remote.retryGetFile(filepath.Join(dst, relKey), key); err != nil {
-			errMap[key.key] = err
-		}
-	}
+		return remote.transfers.Run(func() error {
+			return remote.retryGetFile(filepath.Join(dst, relKey), key)
+		})
+	})
 
 	if len(errMap) > 0 {
 		log.Printf("Errors during getFiles: %v", errMap)
-		return fmt.Errorf("error downloading files from S3")
+		return fmt.Errorf("error downloading files from S3: %v", errMap)
 	}
 
 	return nil
 }
 
-// Wrapper for getFile() that implements retry logic (for avoiding random S3 500's)
+// Wrapper for getFile() that implements retry logic (for avoiding random S3
+// 500's). Each attempt resumes after what the last one downloaded.
 func (remote *S3Remote) retryGetFile(dst string, key *keyDef) error {
-	for i := 1; i <= MaxGetFileAttempts; i++ {
-		err := remote.getFile(dst, key)
-		if err != nil {
-			fmt.Printf("Ran into error while pulling from S3 (%v/%v attempts): %v\n",
-				i, MaxGetFileAttempts, err)
-
-			// Final attempt? -> return err
-			if i == MaxGetFileAttempts {
-				return err
-			}
-		} else {
-			// Downloaded success
-			break
-		}
-	}
-
-	return nil
+	return remote.retry("Pull of "+key.key, func() error {
+		return remote.getFile(dst, key)
+	})
 }
 
 // get a single file from the s3 bucket
+//
+// The file is downloaded to a partial file first, which is kept if the
+// download fails. The next attempt, or the next pull of the same file,
+// resumes after what was already downloaded.
 func (remote *S3Remote) getFile(dst string, key *keyDef) error {
 	log.Printf("Pulling key %s (%s)\n", key.key, utils.HumanSize(key.s3Key.Size))
 
-	from, _, err := remote.getUploadDownloadBucket().GetReader(key.key, nil)
+	partial := remote.partialPath(dst, key)
+
+	for _, dir := range []string{filepath.Dir(dst), filepath.Dir(partial)} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+
+	to, err := os.OpenFile(partial, os.O_RDWR|os.O_CREATE, 0600)
 	if err != nil {
 		return err
 	}
-	defer from.Close()
+	defer to.Close()
+
+	// verify the digest on the way through, files pushed before digests
+	// were written have no sum. What was downloaded before is hashed first.
+	hash := sha256.New()
 
-	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+	offset, err := io.Copy(hash, to)
+	if err != nil {
 		return err
 	}
 
-	to, err := os.Create(dst)
+	if offset > key.s3Key.Size {
+		if offset, err = restartPartial(to, hash); err != nil {
+			return err
+		}
+	}
+
+	if offset < key.s3Key.Size {
+		if offset > 0 {
+			log.Printf("Resuming key %s at %s\n", key.key, utils.HumanSize(offset))
+		}
+
+		from, resumed, err := remote.getReaderAt(key.key, offset)
+		if err != nil {
+			return err
+		}
+		defer from.Close()
+
+		// the whole file was sent
+		if !resumed && offset > 0 {
+			if offset, err = restartPartial(to, hash); err != nil {
+				return err
+			}
+		}
+
+		progressReader := utils.NewProgressReader(from, key.s3Key.Size-offset, key.key)
+
+		_, err = io.Copy(io.MultiWriter(to, hash), progressReader)
+		if err != nil {
+			return err
+		}
+	}
+
+	sum, err := key.Sum()
 	if err != nil {
 		return err
 	}
 
-	progressReader := utils.NewProgressReader(from, key.s3Key.Size, key.key)
+	if sum != "" && sum != hex.EncodeToString(hash.Sum(nil)) {
+		os.Remove(partial)
+		return fmt.Errorf("%v: %s", ErrDigestMismatch, key.key)
+	}
+
+	if err := to.Close(); err != nil {
+		return err
+	}
+
+	return moveFile(partial, dst)
+}
+
+// read key starting at offset. Resumed is false if the whole file is
+// returned instead.
+func (remote *S3Remote) getReaderAt(key string, offset int64) (reader io.ReadCloser, resumed bool, err error) {
+	if offset == 0 {
+		reader, _, err = remote.getUploadDownloadBucket().GetReader(remote.remoteKey(key), nil)
+		return reader, false, err
+	}
+
+	headers := map[string][]string{"Range": {fmt.Sprintf("bytes=%d-", offset)}}
 
-	_, err = io.Copy(to, progressReader)
+	resp, err := remote.getBucket().GetResponseWithHeaders(remote.remoteKey(key), headers)
 	if err != nil {
+		return nil, false, err
+	}
+
+	return resp.Body, resp.StatusCode == http.StatusPartialContent, nil
+}
+
+// Where the download of key to dst is kept until it's complete. With a
+// PartialDir, partial files outlive the pull's work dir so that a re-run can
+// resume them. They're named after the object and its ETag, so a partial of
+// an object that has since been overwritten isn't resumed.
+func (remote *S3Remote) partialPath(dst string, key *keyDef) string {
+	if remote.config.PartialDir == "" {
+		return dst + ".partial"
+	}
+
+	object := sha1.Sum([]byte(remote.BucketName + "/" + remote.remoteKey(key.key) + "@" + key.s3Key.ETag))
+	return filepath.Join(remote.config.PartialDir, hex.EncodeToString(object[:]))
+}
+
+// empty a partial file to download it from the start
+func restartPartial(partial *os.File, hash hash.Hash) (int64, error) {
+	hash.Reset()
+
+	if err := partial.Truncate(0); err != nil {
+		return 0, err
+	}
+
+	_, err := partial.Seek(0, 0)
+	return 0, err
+}
+
+// rename src to dst, copying it if they're on different filesystems
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	if _, err := copyFile(src, dst, ""); err != nil {
 		return err
 	}
 
-	return nil
+	return os.Remove(src)
+}
+
+func (remote *S3Remote) OpenKey(key string) (reader io.ReadCloser, err error) {
+	err = remote.retry("Get of "+key, func() error {
+		reader, _, err = remote.getUploadDownloadBucket().GetReader(remote.remoteKey(key), nil)
+		return err
+	})
+	return reader, err
+}
+
+// The calls to S3 below are retried with backoff by remote.retry, keys
+// are full S3 keys. A 404 isn't retried, callers check for it.
+
+func (remote *S3Remote) getObject(s3Key string) (data []byte, err error) {
+	err = remote.retry("Get of "+s3Key, func() error {
+		data, err = remote.getBucket().Get(s3Key)
+		return err
+	})
+	return data, err
+}
+
+func (remote *S3Remote) objectExists(s3Key string) (exists bool, err error) {
+	err = remote.retry("Check of "+s3Key, func() error {
+		exists, err = remote.getBucket().Exists(s3Key)
+		return err
+	})
+	return exists, err
+}
+
+func (remote *S3Remote) putObject(s3Key string, data []byte, contType string) error {
+	return remote.retry("Put of "+s3Key, func() error {
+		return remote.getBucket().Put(s3Key, data, contType, s3.Private, s3.Options{})
+	})
+}
+
+func (remote *S3Remote) listObjects(prefix, delim, marker string, max int) (resp *s3.ListResp, err error) {
+	err = remote.retry("Listing of '"+prefix+"'", func() error {
+		resp, err = remote.getBucket().List(prefix, delim, marker, max)
+		return err
+	})
+	return resp, err
+}
+
+func (remote *S3Remote) deleteObjects(objects []s3.Object) error {
+	return remote.retry("Delete", func() error {
+		return remote.getBucket().DelMulti(s3.Delete{Quiet: true, Objects: objects})
+	})
+}
+
+func (remote *S3Remote) retry(desc string, fn func() error) error {
+	return RetryPolicyFromConfig(remote.config).Do(desc, fn)
+}
+
+// how many files to push or pull at once
+func (remote *S3Remote) concurrency() int {
+	if remote.config.Concurrency > 0 {
+		return remote.config.Concurrency
+	}
+	return PushNumGoroutines
 }
 
 // path to a tagfile
 func (remote *S3Remote) tagFilePath(repo, tag string) string {
-	return filepath.Join("repositories", repo, tag)
+	return remote.remoteKey(path.Join("repositories", repo, tag))
 }
 
 // path to an image dir
 func (remote *S3Remote) imagePath(id ID) string {
-	return filepath.Join("images", string(id))
+	return remote.remoteKey(path.Join("images", string(id)))
+}
+
+// path to a content addressed layer dir
+func (remote *S3Remote) layerPath(digest ID) string {
+	return remote.remoteKey(path.Join("layers", digest.String()))
+}
+
+// prefix taken from the path of the S3 URL, eg "docker-repo" for
+// s3://bucket/docker-repo/. Several registries can share a bucket this way.
+func (remote *S3Remote) prefix() string {
+	if remote.config.AWS.S3URL == nil {
+		return ""
+	}
+	return strings.Trim(remote.config.AWS.S3URL.Path, "/")
 }
 
+// maps a key relative to the remote (eg "images/123/json") to the S3 key
 func (remote *S3Remote) remoteKey(key string) string {
-	return key
+	return path.Join(remote.prefix(), key)
 }
 
-func (remote *S3Remote) List() (images []Image, err error) {
+// maps an S3 key back to a key relative to the remote, the reverse of remoteKey
+func (remote *S3Remote) relativeKey(s3Key string) string {
+	s3Key = strings.TrimPrefix(s3Key, "/")
+	if prefix := remote.prefix(); prefix != "" {
+		s3Key = strings.TrimPrefix(s3Key, prefix+"/")
+	}
+	return s3Key
+}
 
-	bucket := remote.getBucket()
+// List the bucket contents at prefix, following NextMarker until the listing
+// is complete. With a delimiter, the grouped "directories" are returned too.
+func (remote *S3Remote) listAll(prefix, delim string) (contents []s3.Key, commonPrefixes []string, err error) {
 	nextMarker := ""
 
-	var contents []s3.Key
-
-	for true {
-		resp, err := bucket.List("repositories/", "", nextMarker, 1000)
+	for {
+		resp, err := remote.listObjects(prefix, delim, nextMarker, 1000)
 		if err != nil {
-			log.Printf("%s unable to list images: %s", remote.Desc(), err)
-			return images, err
+			return contents, commonPrefixes, err
 		}
 
 		contents = append(contents, resp.Contents...)
+		commonPrefixes = append(commonPrefixes, resp.CommonPrefixes...)
 
-		if resp.IsTruncated {
-			nextMarker = resp.NextMarker
-		} else {
+		if !resp.IsTruncated {
 			break
 		}
+
+		nextMarker = resp.NextMarker
+
+		// goamz only fills in NextMarker from Contents, S3 should always send
+		// it for delimited listings but don't loop forever if it doesn't.
+		if nextMarker == "" && len(resp.CommonPrefixes) > 0 {
+			nextMarker = resp.CommonPrefixes[len(resp.CommonPrefixes)-1]
+		}
+		if nextMarker == "" {
+			return contents, commonPrefixes, fmt.Errorf("truncated listing at prefix '%s' without a marker", prefix)
+		}
+	}
+
+	return contents, commonPrefixes, nil
+}
+
+func (remote *S3Remote) ListKeys(prefix string) ([]KeyInfo, error) {
+	s3Prefix := remote.remoteKey(prefix)
+
+	// path.Join drops the trailing slash, but "images/123/" mustn't match "images/1234/"
+	if s3Prefix != "" && (prefix == "" || strings.HasSuffix(prefix, "/")) {
+		s3Prefix += "/"
+	}
+
+	contents, _, err := remote.listAll(s3Prefix, "")
+	if err != nil {
+		return nil, fmt.Errorf("getting bucket contents at prefix '%s': %s", s3Prefix, err)
+	}
+
+	keyInfos := make([]KeyInfo, 0, len(contents))
+	for _, key := range contents {
+		lastModified, err := time.Parse(time.RFC3339Nano, key.LastModified)
+		if err != nil {
+			return nil, fmt.Errorf("parsing modification time of '%s': %s", key.Key, err)
+		}
+
+		keyInfos = append(keyInfos, KeyInfo{
+			Key:          remote.relativeKey(key.Key),
+			Size:         key.Size,
+			LastModified: lastModified,
+		})
+	}
+
+	return keyInfos, nil
+}
+
+func (remote *S3Remote) RemoveKeys(keys []string) error {
+	for start := 0; start < len(keys); start += MaxDeleteKeys {
+		end := start + MaxDeleteKeys
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		objects := make([]s3.Object, 0, end-start)
+		for _, key := range keys[start:end] {
+			objects = append(objects, s3.Object{Key: remote.remoteKey(key)})
+		}
+
+		if err := remote.deleteObjects(objects); err != nil {
+			return fmt.Errorf("%s unable to remove keys: %s", remote.Desc(), err)
+		}
+	}
+
+	return nil
+}
+
+func (remote *S3Remote) List() (images []Image, err error) {
+	reposPrefix := remote.remoteKey("repositories") + "/"
+
+	contents, _, err := remote.listAll(reposPrefix, "")
+	if err != nil {
+		log.Printf("%s unable to list images: %s", remote.Desc(), err)
+		return images, err
 	}
 
 	for _, k := range contents {
 		if strings.HasSuffix(k.Key, ".sum") {
 			continue
 		}
-		repo, tag := remote.ParseImagePath(k.Key, "repositories/")
+		repo, tag := remote.ParseImagePath(k.Key, reposPrefix)
 		if err != nil {
-			log.Printf("error splitting S3 key: repositories/")
+			log.Printf("error splitting S3 key: %s", reposPrefix)
 			return images, err
 		}
 
@@ -46,6 +46,10 @@ func (s *S) SetUpSuite(c *C) {
 		c.Fatalf("couldn't initialize config. Error: %s", err)
 	}
 
+	// the test server times out requests it has no response for, tests
+	// that retry set their own policy
+	baseConfig.RetryAttempts = 1
+
 	s.remote = &S3Remote{
 		config:     baseConfig,
 		BucketName: "bucket",
@@ -67,22 +71,116 @@ func (s *S) TestBucket(c *C) {
 func (s *S) TestRepoKeys(c *C) {
 	nelsonSha := "123"
 
-	//testServer.Response(200, nil, "content")
+	testServer.Flush()
 	testServer.Response(200, nil, GetListResultDump1)
 	testServer.Response(200, nil, nelsonSha)
 
 	keys, err := s.remote.repoKeys("")
 	c.Assert(err, IsNil)
 
-	testServer.WaitRequests(2)
-
 	c.Log(keys["Nelson"])
 
 	c.Assert(keys["Nelson"].key, Equals, "Nelson")
-	c.Assert(keys["Nelson"].Sum(), Equals, nelsonSha)
+	sum, err := keys["Nelson"].Sum()
+	c.Assert(err, IsNil)
+	c.Assert(sum, Equals, nelsonSha)
+
+	testServer.WaitRequests(2)
 
 	c.Assert(keys["Neo"].key, Equals, "Neo")
-	c.Assert(keys["Neo"].Sum(), Equals, "")
+	sum, err = keys["Neo"].Sum()
+	c.Assert(err, IsNil)
+	c.Assert(sum, Equals, "")
+}
+
+func (s *S) prefixedRemote(c *C) *S3Remote {
+	prefixed := *s.remote
+	c.Assert(prefixed.config.SetS3URL("s3://bucket/docker-repo/"), IsNil)
+	return &prefixed
+}
+
+func (s *S) TestRemoteKeyPrefix(c *C) {
+	c.Assert(s.remote.tagFilePath("myapp", "latest"), Equals, "repositories/myapp/latest")
+	c.Assert(s.remote.imagePath("123"), Equals, "images/123")
+
+	prefixed := s.prefixedRemote(c)
+	c.Assert(prefixed.tagFilePath("myapp", "latest"), Equals, "docker-repo/repositories/myapp/latest")
+	c.Assert(prefixed.imagePath("123"), Equals, "docker-repo/images/123")
+	c.Assert(prefixed.remoteKey("images/123/json"), Equals, "docker-repo/images/123/json")
+	c.Assert(prefixed.relativeKey("docker-repo/images/123/json"), Equals, "images/123/json")
+}
+
+func (s *S) TestRepoKeysWithPrefix(c *C) {
+	testServer.Flush()
+	testServer.Response(200, nil, GetListResultDump2)
+
+	keys, err := s.prefixedRemote(c).repoKeys("/images/123")
+	c.Assert(err, IsNil)
+
+	req := testServer.WaitRequest()
+	c.Assert(req.Form.Get("prefix"), Equals, "docker-repo/images/123")
+
+	c.Assert(keys["images/123/json"].key, Equals, "images/123/json")
+	c.Assert(keys["images/123/json"].s3Key.Key, Equals, "docker-repo/images/123/json")
+	c.Assert(keys["images/123/layer.tar"].sumKey, Equals, "docker-repo/images/123/layer.tar.sum")
+}
+
+func (s *S) TestRepoKeysPaginated(c *C) {
+	testServer.Flush()
+	testServer.Response(200, nil, GetListResultTruncated)
+	testServer.Response(200, nil, GetListResultDump1)
+
+	keys, err := s.remote.repoKeys("")
+	c.Assert(err, IsNil)
+
+	reqs := testServer.WaitRequests(2)
+	c.Assert(reqs[0].Form.Get("marker"), Equals, "")
+	c.Assert(reqs[1].Form.Get("marker"), Equals, "Bart")
+
+	c.Assert(keys["Bart"].key, Equals, "Bart")
+	c.Assert(keys["Neo"].key, Equals, "Neo")
+}
+
+func (s *S) TestImageFullId(c *C) {
+	testServer.Flush()
+	testServer.Response(200, nil, GetListResultImagePrefixes)
+
+	id, err := s.remote.ImageFullId("abc")
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, ID("abc123def456"))
+
+	req := testServer.WaitRequest()
+	c.Assert(req.Form.Get("prefix"), Equals, "images/abc")
+	c.Assert(req.Form.Get("delimiter"), Equals, "/")
+}
+
+func (s *S) TestListKeys(c *C) {
+	testServer.Flush()
+	testServer.Response(200, nil, GetListResultDump2)
+
+	keyInfos, err := s.prefixedRemote(c).ListKeys(ImagePrefix("123"))
+	c.Assert(err, IsNil)
+
+	req := testServer.WaitRequest()
+	c.Assert(req.Form.Get("prefix"), Equals, "docker-repo/images/123/")
+
+	c.Assert(keyInfos, HasLen, 3)
+	c.Assert(keyInfos[0].Key, Equals, "images/123/json")
+	c.Assert(keyInfos[0].Size, Equals, int64(5))
+	c.Assert(keyInfos[0].LastModified.Year(), Equals, 2006)
+}
+
+func (s *S) TestRemoveKeys(c *C) {
+	testServer.Flush()
+	testServer.Response(200, nil, "")
+
+	err := s.prefixedRemote(c).RemoveKeys([]string{"repositories/myapp/latest", "images/123/json"})
+	c.Assert(err, IsNil)
+
+	req := testServer.WaitRequest()
+	c.Assert(req.Method, Equals, "POST")
+	_, isDelete := req.Form["delete"]
+	c.Assert(isDelete, Equals, true)
 }
 
 func (s *S) TestLocalKeys(c *C) {
@@ -94,11 +192,11 @@ func (s *S) TestLocalKeys(c *C) {
 
 	c.Assert(keys["file1"].key, Equals, "file1")
 	c.Assert(keys["file1"].fullPath, Equals, filepath.Join(s.TempDir, "file1"))
-	c.Assert(keys["file1"].sum, Equals, "2aae6c35c94fcfb415dbe95f408b9ce91ee846ed")
+	c.Assert(keys["file1"].sum, Equals, "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9")
 
 	c.Assert(keys["dir/file2"].key, Equals, "dir/file2")
 	c.Assert(keys["dir/file2"].fullPath, Equals, filepath.Join(s.TempDir, "dir/file2"))
-	c.Assert(keys["dir/file2"].sum, Equals, "dd6944c43fabd03cf643fe0daf625759dbdea808")
+	c.Assert(keys["dir/file2"].sum, Equals, "0e65fb9ae10450aa9c43cac49f26471f1bc1bec88c0e27fe6007f443a5c52e21")
 }
 
 func (s *S) TestResolveImageNameToId(c *C) {
@@ -118,6 +216,25 @@ func (s *S) TestResolveImageNameToId(c *C) {
 	c.Assert(err, Not(IsNil))
 }
 
+func (s *S) TestParseTagRetriesServerErrors(c *C) {
+	retrying := *s.remote
+	retrying.config.RetryAttempts = 3
+	retrying.config.RetryDelay = time.Millisecond
+
+	testServer.Flush()
+	testServer.Response(503, nil, "")
+	testServer.Response(500, nil, "")
+	testServer.Response(200, nil, "123")
+
+	id, err := retrying.ParseTag("ruby", "latest")
+	c.Assert(err, IsNil)
+	c.Assert(string(id), Equals, "123")
+
+	for i := 0; i < 3; i++ {
+		c.Assert(testServer.WaitRequest().URL.Path, Equals, "/bucket/repositories/ruby/latest")
+	}
+}
+
 func dumpFile(temp, filename, content string) error {
 	out := filepath.Join(temp, filename)
 	if err := os.MkdirAll(filepath.Dir(out), 0700); err != nil {
@@ -125,3 +242,126 @@ func dumpFile(temp, filename, content string) error {
 	}
 	return ioutil.WriteFile(out, []byte(content), 0600)
 }
+
+func (s *S) TestChangedKeys(c *C) {
+	root := c.MkDir()
+	dumpFile(root, "images/123/json", "{}")
+	dumpFile(root, "images/123/layer.tar", "layer")
+	dumpFile(root, "images/456/json", "{}")
+
+	remote := s.prefixedRemote(c)
+
+	localKeys, err := remote.localKeys(root)
+	c.Assert(err, IsNil)
+
+	testServer.Flush()
+	testServer.Response(200, nil, GetListResultDump2)
+	testServer.Response(200, nil, GetListResultEmpty)
+	testServer.Response(200, nil, localKeys["images/123/layer.tar"].sum+"\n")
+
+	changed, err := remote.changedKeys(localKeys)
+	c.Assert(err, IsNil)
+
+	c.Assert(testServer.WaitRequest().Form.Get("prefix"), Equals, "docker-repo/images/123")
+	c.Assert(testServer.WaitRequest().Form.Get("prefix"), Equals, "docker-repo/images/456")
+	c.Assert(testServer.WaitRequest().URL.Path, Equals, "/bucket/docker-repo/images/123/layer.tar.sum")
+
+	// the remote json has no sum, so it's pushed again
+	c.Assert(changed, HasLen, 2)
+	c.Assert(changed["images/123/json"], NotNil)
+	c.Assert(changed["images/456/json"], NotNil)
+
+	c.Assert(localKeys.size()-changed.size(), Equals, int64(len("layer")))
+}
+
+func (s *S) TestGetFileResumes(c *C) {
+	content := "hello world, resumed"
+	dst := filepath.Join(c.MkDir(), "layer.tar")
+
+	key := &keyDef{
+		key:    "images/123/layer.tar",
+		sum:    sha256Hex(content),
+		s3Key:  s3.Key{Key: "images/123/layer.tar", Size: int64(len(content)), ETag: `"etag"`},
+		remote: s.remote,
+	}
+
+	// an earlier attempt got this far
+	c.Assert(ioutil.WriteFile(dst+".partial", []byte(content[:5]), 0600), IsNil)
+
+	testServer.Flush()
+	testServer.Response(206, nil, content[5:])
+
+	c.Assert(s.remote.getFile(dst, key), IsNil)
+
+	req := testServer.WaitRequest()
+	c.Assert(req.Header.Get("Range"), Equals, "bytes=5-")
+
+	data, err := ioutil.ReadFile(dst)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, content)
+
+	_, err = os.Stat(dst + ".partial")
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *S) TestGetFileRestartsWhenRangeIgnored(c *C) {
+	content := "hello world, again"
+	dst := filepath.Join(c.MkDir(), "layer.tar")
+
+	key := &keyDef{
+		key:    "images/123/layer.tar",
+		sum:    sha256Hex(content),
+		s3Key:  s3.Key{Key: "images/123/layer.tar", Size: int64(len(content))},
+		remote: s.remote,
+	}
+
+	c.Assert(ioutil.WriteFile(dst+".partial", []byte("stale"), 0600), IsNil)
+
+	testServer.Flush()
+	testServer.Response(200, nil, content)
+
+	c.Assert(s.remote.getFile(dst, key), IsNil)
+
+	data, err := ioutil.ReadFile(dst)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, content)
+}
+
+func (s *S) TestGetFileUnreadableSum(c *C) {
+	content := "hello world"
+	dst := filepath.Join(c.MkDir(), "layer.tar")
+
+	key := &keyDef{
+		key:    "images/123/layer.tar",
+		sumKey: "images/123/layer.tar.sum",
+		s3Key:  s3.Key{Key: "images/123/layer.tar", Size: int64(len(content))},
+		remote: s.remote,
+	}
+
+	// downloaded already, only the sum is left to get
+	c.Assert(ioutil.WriteFile(dst+".partial", []byte(content), 0600), IsNil)
+
+	testServer.Flush()
+	testServer.Response(403, nil, "")
+
+	// listed, so the file can't go unverified
+	c.Assert(s.remote.getFile(dst, key), ErrorMatches, "getting the sum of images/123/layer.tar.*")
+
+	_, err := os.Stat(dst)
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *S) TestPartialPath(c *C) {
+	key := &keyDef{key: "images/123/layer.tar", s3Key: s3.Key{ETag: `"etag"`}}
+	c.Assert(s.remote.partialPath("/tmp/pull/layer.tar", key), Equals, "/tmp/pull/layer.tar.partial")
+
+	withDir := *s.remote
+	withDir.config.PartialDir = "/tmp/partial"
+
+	path := withDir.partialPath("/tmp/pull/layer.tar", key)
+	c.Assert(filepath.Dir(path), Equals, "/tmp/partial")
+
+	// another version of the object isn't resumed
+	key.s3Key.ETag = `"other"`
+	c.Assert(withDir.partialPath("/tmp/pull/layer.tar", key), Not(Equals), path)
+}
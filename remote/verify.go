@@ -0,0 +1,208 @@
+package remote
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// A missing or corrupt file found while verifying a remote
+type Problem struct {
+	Key string
+	Err error
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: %v", p.Key, p.Err)
+}
+
+// Checks the files on a remote against the sha256 digests pushed alongside
+// them. Each file is only checked once, however many tags share it.
+type Verifier struct {
+	r    Remote
+	seen map[string]bool
+
+	// files whose digest matched, and their total size
+	Checked int
+	Size    int64
+
+	// files pushed without a digest, which can't be checked
+	NoDigest []string
+
+	Problems []Problem
+}
+
+func NewVerifier(r Remote) *Verifier {
+	return &Verifier{
+		r:    r,
+		seen: make(map[string]bool),
+	}
+}
+
+// VerifyRemote checks every tag resolves to a complete image, then every file
+// on the remote.
+func (v *Verifier) VerifyRemote() error {
+	images, err := v.r.List()
+	if err != nil {
+		return err
+	}
+
+	for _, image := range images {
+		id, err := v.r.ParseTag(image.Repository, image.Tag)
+		if err != nil {
+			return err
+		}
+
+		if err := v.VerifyImage(id); err != nil {
+			return err
+		}
+	}
+
+	return v.VerifyPrefix("")
+}
+
+// VerifyImage checks the files of the chain of images starting at id, and
+// of their layers.
+func (v *Verifier) VerifyImage(id ID) error {
+	return v.r.WalkImages(id, func(id ID, image docker.Image, err error) error {
+		if err == ErrNoSuchImage {
+			prefix := ImagePrefix(id)
+			if v.seen[prefix] {
+				return BreakWalk
+			}
+			v.missing(prefix)
+
+			// its ancestors can still be checked if the json is there
+			parent, err := incompleteParent(v.r, id)
+			if _, ok := err.(BrokenImageError); ok {
+				return BreakWalk
+			} else if err != nil {
+				return err
+			}
+
+			if err := v.VerifyPrefix(prefix); err != nil {
+				return err
+			}
+			if err := v.VerifyImage(parent); err != nil {
+				return err
+			}
+			return BreakWalk
+		} else if err != nil {
+			return err
+		}
+
+		if err := v.VerifyPrefix(ImagePrefix(id)); err != nil {
+			return err
+		}
+
+		layers, err := v.r.ImageLayers(id)
+		if err != nil {
+			return err
+		}
+
+		for _, layer := range layers {
+			exists, err := v.r.LayerExists(layer)
+			if err != nil {
+				return err
+			}
+
+			if !exists {
+				v.missing(LayerPrefix(layer))
+				continue
+			}
+
+			if err := v.VerifyPrefix(LayerPrefix(layer)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// VerifyPrefix checks the files whose key starts with prefix
+func (v *Verifier) VerifyPrefix(prefix string) error {
+	keyInfos, err := v.r.ListKeys(prefix)
+	if err != nil {
+		return err
+	}
+
+	exists := make(map[string]bool)
+	for _, keyInfo := range keyInfos {
+		exists[keyInfo.Key] = true
+	}
+
+	for _, keyInfo := range keyInfos {
+		key := keyInfo.Key
+		if v.seen[key] {
+			continue
+		}
+		v.seen[key] = true
+
+		if strings.HasSuffix(key, ".sum") {
+			if file := strings.TrimSuffix(key, ".sum"); !exists[file] {
+				v.Problems = append(v.Problems, Problem{file, ErrMissingFile})
+			}
+			continue
+		}
+
+		if !exists[key+".sum"] {
+			v.NoDigest = append(v.NoDigest, key)
+			continue
+		}
+
+		if err := v.verifyKey(key); err == ErrDigestMismatch {
+			v.Problems = append(v.Problems, Problem{key, err})
+		} else if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		} else {
+			v.Checked++
+			v.Size += keyInfo.Size
+		}
+	}
+
+	return nil
+}
+
+// report a missing image or layer, once
+func (v *Verifier) missing(prefix string) {
+	if !v.seen[prefix] {
+		v.seen[prefix] = true
+		v.Problems = append(v.Problems, Problem{prefix, ErrNoSuchImage})
+	}
+}
+
+func (v *Verifier) verifyKey(key string) error {
+	sumReader, err := v.r.OpenKey(key + ".sum")
+	if err != nil {
+		return err
+	}
+	defer sumReader.Close()
+
+	sum, err := ioutil.ReadAll(sumReader)
+	if err != nil {
+		return err
+	}
+
+	reader, err := v.r.OpenKey(key)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, reader); err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(string(sum)) != hex.EncodeToString(hash.Sum(nil)) {
+		return ErrDigestMismatch
+	}
+
+	return nil
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/dogestry/dogestry/config"
+)
+
+// How clients authenticate to the server, and what they may pull
+type Auth struct {
+	// shared token clients send as "Authorization: Bearer <token>"
+	Token string
+
+	// remotes the server pulls from, eg "s3://bucket/prefix/". A remote is
+	// allowed if it's one of these or below one of them.
+	AllowedRemotes []string
+
+	// accept AWS credentials from clients in X-Registry-Auth
+	LegacyAuth bool
+}
+
+var (
+	ErrUnauthenticated = errors.New("Client not authenticated to the dogestry server")
+	ErrNoCredentials   = errors.New("The dogestry server has no AWS credentials of its own, and the client sent none")
+	ErrLegacyAuth      = errors.New("AWS credentials in X-Registry-Auth are refused, run the dogestry server with -legacy-auth to accept them")
+)
+
+// Whether the client sent the server's token, as a bearer token or the
+// password of basic auth, or a client certificate the server verified
+func (s *Server) authenticated(req *http.Request) bool {
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		return true
+	}
+
+	if s.Auth.Token == "" {
+		return false
+	}
+
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if _, password, ok := req.BasicAuth(); ok {
+		token = password
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.Auth.Token)) == 1
+}
+
+// pullConfig works out the config of a pull request: the server's own
+// credentials for authenticated clients, or the ones the client sent with
+// -legacy-auth. Either way the remote has to be allowed.
+func (s *Server) pullConfig(req *http.Request) (config.Config, int, error) {
+	authenticated := s.authenticated(req)
+	authHeader := req.Header.Get("X-Registry-Auth")
+
+	// without a token clients can't authenticate, legacy clients send credentials instead
+	if !authenticated && (s.Auth.Token != "" || authHeader == "") {
+		return config.Config{}, http.StatusUnauthorized, ErrUnauthenticated
+	}
+
+	var cfg config.Config
+
+	if authHeader != "" {
+		if !s.Auth.LegacyAuth {
+			return cfg, http.StatusForbidden, ErrLegacyAuth
+		}
+
+		var err error
+		if cfg, err = config.NewServerConfig(authHeader); err != nil {
+			return cfg, http.StatusBadRequest, err
+		}
+	} else {
+		if s.Config == nil {
+			return cfg, http.StatusForbidden, ErrNoCredentials
+		}
+
+		cfg = *s.Config
+		if err := cfg.SetS3URL(req.URL.Query().Get("remote")); err != nil {
+			return cfg, http.StatusBadRequest, fmt.Errorf("Invalid remote: %v", err)
+		}
+	}
+
+	if !s.remoteAllowed(cfg.AWS.S3URL, authHeader == "") {
+		return cfg, http.StatusForbidden, fmt.Errorf("Remote %s is not allowed by the dogestry server", cfg.AWS.S3URL)
+	}
+
+	return cfg, http.StatusOK, nil
+}
+
+// Whether the server may pull from remote. Pulls with the server's own
+// credentials need the remote to be listed, pulls with the client's only if
+// there's a list. Local paths on the server are never allowed.
+func (s *Server) remoteAllowed(remote *url.URL, serverCredentials bool) bool {
+	if remote.Scheme != "s3" {
+		return false
+	}
+
+	if len(s.Auth.AllowedRemotes) == 0 {
+		return !serverCredentials
+	}
+
+	for _, allowed := range s.Auth.AllowedRemotes {
+		allowedURL, err := url.Parse(allowed)
+		if err != nil || allowedURL.Scheme != remote.Scheme || allowedURL.Host != remote.Host {
+			continue
+		}
+
+		// prefixes match on whole path segments, s3://bucket/app doesn't allow s3://bucket/apple.
+		// Keys are joined to the path, which resolves "..", so it's compared resolved.
+		prefix := strings.Trim(path.Clean("/"+allowedURL.Path), "/")
+		remotePath := strings.Trim(path.Clean("/"+remote.Path), "/")
+
+		if prefix == "" || remotePath == prefix || strings.HasPrefix(remotePath, prefix+"/") {
+			return true
+		}
+	}
+
+	return false
+}
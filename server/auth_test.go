@@ -0,0 +1,100 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/dogestry/dogestry/config"
+)
+
+func pullRequest(remote, token, authHeader string) *http.Request {
+	req := httptest.NewRequest("POST", "/1.19/images/create?fromImage=app&remote="+url.QueryEscape(remote), nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if authHeader != "" {
+		req.Header.Set("X-Registry-Auth", authHeader)
+	}
+	return req
+}
+
+func legacyAuthHeader(remote string) string {
+	return base64.StdEncoding.EncodeToString([]byte(`{"username":"client-access","password":"client-secret","email":"` + remote + `"}`))
+}
+
+func TestPullConfigServerCredentials(t *testing.T) {
+	s := New("", "", Auth{Token: "secret", AllowedRemotes: []string{"s3://bucket/app/"}}, &config.Config{}, nil)
+	s.Config.AWS.AccessKeyID = "server-access"
+
+	cfg, status, err := s.pullConfig(pullRequest("s3://bucket/app/?region=eu-west-1", "secret", ""))
+	if err != nil {
+		t.Fatalf("an authenticated pull from an allowed remote should work. Error: %v", err)
+	}
+	if status != http.StatusOK || cfg.AWS.AccessKeyID != "server-access" || cfg.AWS.Region != "eu-west-1" {
+		t.Errorf("the server's credentials should be used for the remote, got %d %+v", status, cfg.AWS)
+	}
+	if s.Config.AWS.S3URL != nil {
+		t.Error("the server's config shouldn't be changed by a pull")
+	}
+
+	if _, status, _ := s.pullConfig(pullRequest("s3://bucket/app/", "wrong", "")); status != http.StatusUnauthorized {
+		t.Errorf("a wrong token should be refused, got %d", status)
+	}
+
+	for _, remote := range []string{"s3://bucket/apple/", "s3://other/app/", "file:///var/lib/images"} {
+		if _, status, _ := s.pullConfig(pullRequest(remote, "secret", "")); status != http.StatusForbidden {
+			t.Errorf("%s should not be allowed, got %d", remote, status)
+		}
+	}
+
+	// a client certificate the server verified authenticates too
+	req := pullRequest("s3://bucket/app/nested", "", "")
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{&x509.Certificate{}}}}
+	if _, _, err := s.pullConfig(req); err != nil {
+		t.Errorf("a verified client certificate should authenticate. Error: %v", err)
+	}
+}
+
+func TestPullConfigPathTraversal(t *testing.T) {
+	s := New("", "", Auth{Token: "secret", AllowedRemotes: []string{"s3://bucket/app/"}}, &config.Config{}, nil)
+
+	for _, remote := range []string{"s3://bucket/app/../secret/", "s3://bucket/app/nested/../../secret", "s3://bucket/app/.."} {
+		if _, status, _ := s.pullConfig(pullRequest(remote, "secret", "")); status != http.StatusForbidden {
+			t.Errorf("%s leaves the allowed prefix and should not be allowed, got %d", remote, status)
+		}
+	}
+
+	if _, _, err := s.pullConfig(pullRequest("s3://bucket/app/nested/../other/", "secret", "")); err != nil {
+		t.Errorf("a path staying below the allowed prefix should work. Error: %v", err)
+	}
+}
+
+func TestPullConfigLegacyAuth(t *testing.T) {
+	remote := "s3://bucket/app/"
+
+	s := New("", "", Auth{Token: "secret"}, nil, nil)
+	if _, status, _ := s.pullConfig(pullRequest(remote, "secret", legacyAuthHeader(remote))); status != http.StatusForbidden {
+		t.Errorf("client credentials should only be accepted with -legacy-auth, got %d", status)
+	}
+	if _, status, _ := s.pullConfig(pullRequest(remote, "secret", "")); status != http.StatusForbidden {
+		t.Errorf("without credentials of its own the server can't pull, got %d", status)
+	}
+
+	s = New("", "", Auth{LegacyAuth: true}, &config.Config{}, nil)
+	cfg, _, err := s.pullConfig(pullRequest("", "", legacyAuthHeader(remote)))
+	if err != nil {
+		t.Fatalf("legacy clients should still be able to pull. Error: %v", err)
+	}
+	if cfg.AWS.AccessKeyID != "client-access" || cfg.AWS.S3URL.String() != remote {
+		t.Errorf("the client's credentials and remote should be used, got %+v", cfg.AWS)
+	}
+
+	if _, status, _ := s.pullConfig(pullRequest(remote, "", "")); status != http.StatusUnauthorized {
+		t.Errorf("the server's own credentials need an authenticated client, got %d", status)
+	}
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/dogestry/dogestry/cli"
+	"github.com/dogestry/dogestry/config"
+)
+
+// A pull running on the server. Every request for the same image streams
+// its status messages, from the first one on, until it's done.
+type pullJob struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	messages [][]byte
+	done     bool
+}
+
+func newPullJob() *pullJob {
+	job := &pullJob{}
+	job.cond = sync.NewCond(&job.mu)
+	return job
+}
+
+func (job *pullJob) write(msg []byte) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	job.messages = append(job.messages, msg)
+	job.cond.Broadcast()
+}
+
+// the last message of the job
+func (job *pullJob) finish(msg []byte) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	job.messages = append(job.messages, msg)
+	job.done = true
+	job.cond.Broadcast()
+}
+
+// Write the job's messages to response as they come, until it's done
+func (job *pullJob) stream(response http.ResponseWriter) {
+	sent := 0
+
+	for {
+		job.mu.Lock()
+		for sent == len(job.messages) && !job.done {
+			job.cond.Wait()
+		}
+		messages := job.messages[sent:]
+		done := job.done
+		job.mu.Unlock()
+
+		for _, msg := range messages {
+			response.Write(msg)
+		}
+		sent += len(messages)
+
+		if f, ok := response.(http.Flusher); ok {
+			f.Flush()
+		}
+
+		if done {
+			return
+		}
+	}
+}
+
+// Pulls are the same if they load the same image under the same name from
+// the same remote. The name is part of it since docker tags the image with it.
+func pullKey(cfg config.Config, image, id string) string {
+	return fmt.Sprintf("%s %s %s", cfg.AWS.S3URL, image, id)
+}
+
+// The pull running for key, or a new one. started tells if it's new, and
+// the caller has to run it then.
+func (s *Server) startPull(key string) (job *pullJob, started bool) {
+	s.pullsMu.Lock()
+	defer s.pullsMu.Unlock()
+
+	if job, ok := s.pulls[key]; ok {
+		return job, false
+	}
+
+	job = newPullJob()
+	s.pulls[key] = job
+	return job, true
+}
+
+// Later requests for key start a pull of their own, the image may have
+// moved on by then
+func (s *Server) endPull(key string) {
+	s.pullsMu.Lock()
+	defer s.pullsMu.Unlock()
+
+	delete(s.pulls, key)
+}
+
+// Run the pull of job. It carries on if the request that started it goes
+// away, others may be waiting for it. The waiters stream the job's messages,
+// not its files, so the pull's temp dir goes once the job is finished.
+func (s *Server) runPull(job *pullJob, key string, dogestryCli *cli.DogestryCli, cfg config.Config, image string) {
+	defer dogestryCli.Cleanup()
+
+	job.write(s.statusJSON(fmt.Sprintf("Pulling %s from S3...", image)))
+
+	err := dogestryCli.CmdPull(cfg.AWS.S3URL.String(), image)
+
+	s.endPull(key)
+
+	if err != nil {
+		fmt.Printf("Error pulling image from S3: %v\n", err.Error())
+		job.finish(s.errorJSON("Dogestry server error: " + err.Error()))
+		return
+	}
+
+	job.finish(s.statusJSON("Done"))
+}
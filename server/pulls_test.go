@@ -0,0 +1,59 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dogestry/dogestry/config"
+)
+
+func TestPullsShareJob(t *testing.T) {
+	s := New("", "", Auth{}, nil, nil)
+
+	cfg := config.Config{}
+	cfg.SetS3URL("s3://bucket/app/")
+
+	key := pullKey(cfg, "myapp:latest", "abc")
+	if pullKey(cfg, "myapp:v2", "abc") == key || pullKey(cfg, "myapp:latest", "def") == key {
+		t.Error("pulls of another name or image should be separate")
+	}
+
+	job, started := s.startPull(key)
+	if !started {
+		t.Fatal("the first pull should start a job")
+	}
+
+	other, started := s.startPull(key)
+	if started || other != job {
+		t.Fatal("a pull of the same image should attach to the running job")
+	}
+
+	job.write([]byte("first"))
+
+	// attached late, still gets everything
+	recorder := httptest.NewRecorder()
+	streamed := make(chan bool)
+	go func() {
+		other.stream(recorder)
+		close(streamed)
+	}()
+
+	select {
+	case <-streamed:
+		t.Fatal("the stream should last until the job is done")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.endPull(key)
+	job.finish([]byte("done"))
+	<-streamed
+
+	if recorder.Body.String() != "firstdone" {
+		t.Errorf("expected all the job's messages, got %q", recorder.Body.String())
+	}
+
+	if _, started := s.startPull(key); !started {
+		t.Error("a pull after the job ended should start a new one")
+	}
+}
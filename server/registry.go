@@ -0,0 +1,592 @@
+package server
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dogestry/dogestry/remote"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/gorilla/mux"
+)
+
+const (
+	manifestMediaType = "application/vnd.docker.distribution.manifest.v2+json"
+	configMediaType   = "application/vnd.docker.container.image.v1+json"
+
+	// layers are stored as `docker save` exports them, uncompressed
+	layerMediaType = "application/vnd.docker.image.rootfs.diff.tar"
+)
+
+var (
+	repoNamePattern  = regexp.MustCompile(`^[a-z0-9]+(?:[._-][a-z0-9]+)*(?:/[a-z0-9]+(?:[._-][a-z0-9]+)*)*$`)
+	tagPattern       = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	digestPattern    = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+	errUnknownDigest = errors.New("unknown digest")
+)
+
+// how many manifests, with their blobs, are kept for serving
+const maxCachedManifests = 1000
+
+// Serves the Docker Registry HTTP API v2 from a remote. Schema 2 manifests
+// are made up from the images and layers on the remote as they're asked for.
+type Registry struct {
+	remote remote.Remote
+
+	// where pushed blobs are kept, the registry is read-only if empty
+	uploadDir string
+
+	// the blobs and manifests served, by digest. The configs of legacy images
+	// are made up and their layers aren't stored by digest, so they can only
+	// be found once their manifest has been asked for. The manifests least
+	// recently asked for are dropped past maxCachedManifests, along with the
+	// blobs no other manifest lists, and made up again when asked for.
+	mu        sync.Mutex
+	blobs     map[string]blob
+	blobRefs  map[string]int
+	manifests map[string]*list.Element
+	recent    *list.List
+
+	// pushed blobs in use by the manifests being pushed, by hex digest.
+	// Pushes can share them, so they're only removed by the last one.
+	held map[string]*heldBlob
+}
+
+// A manifest served before and the blobs it lists
+type cachedManifest struct {
+	digest string
+	data   []byte
+	blobs  map[string]blob
+}
+
+// A blob is either a key on the remote, pushed to the registry or made up
+type blob struct {
+	key  string
+	file string
+	data []byte
+	size int64
+}
+
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Size      int64  `json:"size"`
+	Digest    string `json:"digest"`
+}
+
+type manifestV2 struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Config        descriptor   `json:"config"`
+	Layers        []descriptor `json:"layers"`
+}
+
+type registryError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func NewRegistry(r remote.Remote, uploadDir string) *Registry {
+	return &Registry{
+		remote:    r,
+		uploadDir: uploadDir,
+		blobs:     make(map[string]blob),
+		blobRefs:  make(map[string]int),
+		manifests: make(map[string]*list.Element),
+		recent:    list.New(),
+		held:      make(map[string]*heldBlob),
+	}
+}
+
+func (reg *Registry) routes(router *mux.Router, wrap func(http.HandlerFunc) http.Handler) {
+	if reg.uploadDir != "" {
+		reg.pushRoutes(router, wrap)
+	}
+
+	router.Handle("/v2/", wrap(reg.baseHandler)).Methods("GET")
+	router.Handle("/v2/{name:.+}/tags/list", wrap(reg.tagsHandler)).Methods("GET")
+	router.Handle("/v2/{name:.+}/manifests/{reference}", wrap(reg.manifestHandler)).Methods("GET", "HEAD")
+	router.Handle("/v2/{name:.+}/blobs/{digest}", wrap(reg.blobHandler)).Methods("GET", "HEAD")
+}
+
+func writeRegistryError(response http.ResponseWriter, status int, code, message string) {
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(status)
+
+	data, _ := json.Marshal(map[string][]registryError{"errors": {{code, message}}})
+	response.Write(data)
+}
+
+func (reg *Registry) baseHandler(response http.ResponseWriter, req *http.Request) {
+	response.Header().Set("Content-Type", "application/json")
+	response.Write([]byte("{}"))
+}
+
+func (reg *Registry) tagsHandler(response http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["name"]
+	if !repoNamePattern.MatchString(name) {
+		writeRegistryError(response, http.StatusBadRequest, "NAME_INVALID", "invalid repository name")
+		return
+	}
+
+	tags, err := reg.tags(name)
+	if err != nil {
+		writeRegistryError(response, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	} else if len(tags) == 0 {
+		writeRegistryError(response, http.StatusNotFound, "NAME_UNKNOWN", "repository name not known to registry")
+		return
+	}
+
+	data, err := json.Marshal(struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+	}{name, tags})
+	if err != nil {
+		writeRegistryError(response, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	response.Write(data)
+}
+
+// the tags of the repo name, sorted
+func (reg *Registry) tags(name string) ([]string, error) {
+	prefix := path.Dir(remote.TagKey(name, "tag")) + "/"
+
+	keyInfos, err := reg.remote.ListKeys(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make([]string, 0)
+	for _, keyInfo := range keyInfos {
+		tag := strings.TrimPrefix(keyInfo.Key, prefix)
+
+		// tags of repos below this one, and checksums of tag files
+		if strings.Contains(tag, "/") || strings.HasSuffix(tag, ".sum") {
+			continue
+		}
+		tags = append(tags, tag)
+	}
+
+	sort.Strings(tags)
+	return tags, nil
+}
+
+func (reg *Registry) manifestHandler(response http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["name"]
+	reference := mux.Vars(req)["reference"]
+
+	if !repoNamePattern.MatchString(name) {
+		writeRegistryError(response, http.StatusBadRequest, "NAME_INVALID", "invalid repository name")
+		return
+	}
+
+	var manifest []byte
+	var err error
+
+	if digestPattern.MatchString(reference) {
+		manifest, err = reg.manifestByDigest(name, reference)
+	} else if tagPattern.MatchString(reference) {
+		manifest, err = reg.manifestByTag(name, reference)
+	} else {
+		writeRegistryError(response, http.StatusBadRequest, "MANIFEST_INVALID", "invalid tag or digest")
+		return
+	}
+
+	if err == remote.ErrNoSuchImage || err == remote.ErrNoSuchTag {
+		writeRegistryError(response, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+		return
+	} else if err != nil {
+		fmt.Printf("Error serving manifest %s:%s: %v\n", name, reference, err)
+		writeRegistryError(response, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+
+	response.Header().Set("Content-Type", manifestMediaType)
+	response.Header().Set("Content-Length", strconv.Itoa(len(manifest)))
+	response.Header().Set("Docker-Content-Digest", digestOf(manifest))
+
+	if req.Method != "HEAD" {
+		response.Write(manifest)
+	}
+}
+
+func (reg *Registry) manifestByTag(name, tag string) ([]byte, error) {
+	id, err := reg.remote.ParseTag(name, tag)
+	if err != nil {
+		return nil, err
+	} else if id == "" {
+		return nil, remote.ErrNoSuchTag
+	}
+
+	return reg.manifest(id)
+}
+
+// A manifest seen before, or else the one of any tag of the repo name
+func (reg *Registry) manifestByDigest(name, digest string) ([]byte, error) {
+	if manifest, ok := reg.cachedManifest(digest); ok {
+		return manifest, nil
+	}
+
+	tags, err := reg.tags(name)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tag := range tags {
+		manifest, err := reg.manifestByTag(name, tag)
+		if err == remote.ErrNoSuchImage || err == remote.ErrNoSuchTag {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if digestOf(manifest) == digest {
+			return manifest, nil
+		}
+	}
+
+	return nil, remote.ErrNoSuchImage
+}
+
+// The schema 2 manifest of image id. Its blobs can be served from then on.
+func (reg *Registry) manifest(id remote.ID) ([]byte, error) {
+	layers, err := reg.remote.ImageLayers(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var config blob
+	var configDigest string
+	var layerBlobs []blob
+	var layerDigests []string
+
+	// Docker 1.10+ images are stored content addressed already
+	if len(layers) > 0 {
+		config, layerBlobs, layerDigests, err = reg.image(id, layers)
+		configDigest = "sha256:" + id.String()
+	} else {
+		config, layerBlobs, layerDigests, err = reg.legacyImage(id)
+		configDigest = digestOf(config.data)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := manifestV2{
+		SchemaVersion: 2,
+		MediaType:     manifestMediaType,
+		Config:        descriptor{configMediaType, config.size, configDigest},
+		Layers:        make([]descriptor, len(layerBlobs)),
+	}
+	for i, layerBlob := range layerBlobs {
+		manifest.Layers[i] = descriptor{layerMediaType, layerBlob.size, layerDigests[i]}
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "   ")
+	if err != nil {
+		return nil, err
+	}
+
+	blobs := map[string]blob{configDigest: config}
+	for i, layerBlob := range layerBlobs {
+		blobs[layerDigests[i]] = layerBlob
+	}
+	reg.cacheManifest(digestOf(data), data, blobs)
+
+	return data, nil
+}
+
+func (reg *Registry) cachedManifest(digest string) ([]byte, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	element, ok := reg.manifests[digest]
+	if !ok {
+		return nil, false
+	}
+
+	reg.recent.MoveToFront(element)
+	return element.Value.(*cachedManifest).data, true
+}
+
+// Keep a manifest and its blobs for serving, dropping the least recently
+// used ones past maxCachedManifests
+func (reg *Registry) cacheManifest(digest string, data []byte, blobs map[string]blob) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if element, ok := reg.manifests[digest]; ok {
+		reg.recent.MoveToFront(element)
+		return
+	}
+
+	reg.manifests[digest] = reg.recent.PushFront(&cachedManifest{digest, data, blobs})
+	for digest, b := range blobs {
+		reg.blobs[digest] = b
+		reg.blobRefs[digest]++
+	}
+
+	for reg.recent.Len() > maxCachedManifests {
+		oldest := reg.recent.Remove(reg.recent.Back()).(*cachedManifest)
+		delete(reg.manifests, oldest.digest)
+
+		for digest := range oldest.blobs {
+			if reg.blobRefs[digest]--; reg.blobRefs[digest] == 0 {
+				delete(reg.blobs, digest)
+				delete(reg.blobRefs, digest)
+			}
+		}
+	}
+}
+
+// Config and layers of a Docker 1.10+ image, as stored
+func (reg *Registry) image(id remote.ID, layers []remote.ID) (blob, []blob, []string, error) {
+	config, err := reg.keyBlob(remote.ImagePrefix(id), "config.json")
+	if err != nil {
+		return blob{}, nil, nil, err
+	}
+
+	layerBlobs := make([]blob, len(layers))
+	layerDigests := make([]string, len(layers))
+
+	for i, layer := range layers {
+		if layerBlobs[i], err = reg.keyBlob(remote.LayerPrefix(layer), "layer.tar"); err != nil {
+			return blob{}, nil, nil, err
+		}
+		layerDigests[i] = "sha256:" + layer.String()
+	}
+
+	return config, layerBlobs, layerDigests, nil
+}
+
+// The key named name below prefix, as a blob
+func (reg *Registry) keyBlob(prefix, name string) (blob, error) {
+	keyInfos, err := reg.remote.ListKeys(prefix)
+	if err != nil {
+		return blob{}, err
+	}
+
+	for _, keyInfo := range keyInfos {
+		if keyInfo.Key == prefix+name {
+			return blob{key: keyInfo.Key, size: keyInfo.Size}, nil
+		}
+	}
+
+	return blob{}, remote.ErrNoSuchImage
+}
+
+// Made up config of a legacy image, as docker does when migrating one: the
+// metadata of the image with the layers of its history, base layer first.
+func (reg *Registry) legacyImage(id remote.ID) (blob, []blob, []string, error) {
+	history := make([]remote.ID, 0)
+	err := reg.remote.WalkImages(id, func(id remote.ID, image docker.Image, err error) error {
+		if err != nil {
+			return err
+		}
+		history = append([]remote.ID{id}, history...)
+		return nil
+	})
+	if err != nil {
+		return blob{}, nil, nil, err
+	}
+
+	type legacyHistory struct {
+		Created   time.Time `json:"created"`
+		Author    string    `json:"author,omitempty"`
+		CreatedBy string    `json:"created_by,omitempty"`
+		Comment   string    `json:"comment,omitempty"`
+	}
+
+	var rootFS struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	}
+	rootFS.Type = "layers"
+
+	layers := make([]blob, 0, len(history))
+	historyItems := make([]legacyHistory, 0, len(history))
+	var imageJson []byte
+
+	for _, historyId := range history {
+		prefix := remote.ImagePrefix(historyId)
+
+		layer, err := reg.keyBlob(prefix, "layer.tar")
+		if err != nil {
+			return blob{}, nil, nil, err
+		}
+
+		digest, err := reg.keyDigest(layer.key)
+		if err != nil {
+			return blob{}, nil, nil, err
+		}
+
+		if imageJson, err = reg.readKey(prefix + "json"); err != nil {
+			return blob{}, nil, nil, err
+		}
+
+		var v1 struct {
+			legacyHistory
+			ContainerConfig struct {
+				Cmd []string
+			} `json:"container_config"`
+		}
+		if err := json.Unmarshal(imageJson, &v1); err != nil {
+			return blob{}, nil, nil, err
+		}
+		v1.CreatedBy = strings.Join(v1.ContainerConfig.Cmd, " ")
+
+		layers = append(layers, layer)
+		rootFS.DiffIDs = append(rootFS.DiffIDs, digest)
+		historyItems = append(historyItems, v1.legacyHistory)
+	}
+
+	// the image's own json, less what only applies to legacy images
+	var config map[string]*json.RawMessage
+	if err := json.Unmarshal(imageJson, &config); err != nil {
+		return blob{}, nil, nil, err
+	}
+	for _, key := range []string{"id", "parent", "Size", "parent_id", "layer_id", "throwaway"} {
+		delete(config, key)
+	}
+
+	for key, value := range map[string]interface{}{"rootfs": rootFS, "history": historyItems} {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return blob{}, nil, nil, err
+		}
+		raw := json.RawMessage(data)
+		config[key] = &raw
+	}
+
+	// keys are sorted, the same image always gets the same config
+	data, err := json.Marshal(config)
+	if err != nil {
+		return blob{}, nil, nil, err
+	}
+
+	return blob{data: data, size: int64(len(data))}, layers, rootFS.DiffIDs, nil
+}
+
+// sha256 digest of key, from its .sum file or else read in full
+func (reg *Registry) keyDigest(key string) (string, error) {
+	if sum, err := reg.readKey(key + ".sum"); err == nil {
+		return "sha256:" + strings.TrimSpace(string(sum)), nil
+	}
+
+	reader, err := reg.remote.OpenKey(key)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, reader); err != nil {
+		return "", err
+	}
+
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (reg *Registry) readKey(key string) ([]byte, error) {
+	reader, err := reg.remote.OpenKey(key)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+func (reg *Registry) blobHandler(response http.ResponseWriter, req *http.Request) {
+	digest := mux.Vars(req)["digest"]
+	if !digestPattern.MatchString(digest) {
+		writeRegistryError(response, http.StatusBadRequest, "DIGEST_INVALID", "invalid digest")
+		return
+	}
+
+	b, err := reg.blob(digest)
+	if err == errUnknownDigest {
+		writeRegistryError(response, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown to registry")
+		return
+	} else if err != nil {
+		writeRegistryError(response, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+
+	var reader io.ReadCloser = ioutil.NopCloser(bytes.NewReader(b.data))
+	if b.key != "" && req.Method != "HEAD" {
+		reader, err = reg.remote.OpenKey(b.key)
+	} else if b.file != "" && req.Method != "HEAD" {
+		reader, err = os.Open(b.file)
+	}
+
+	if err != nil {
+		writeRegistryError(response, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+	defer reader.Close()
+
+	response.Header().Set("Content-Type", "application/octet-stream")
+	response.Header().Set("Content-Length", strconv.FormatInt(b.size, 10))
+	response.Header().Set("Docker-Content-Digest", digest)
+
+	if req.Method != "HEAD" {
+		if _, err := io.Copy(response, reader); err != nil {
+			fmt.Printf("Error serving blob %s: %v\n", digest, err)
+		}
+	}
+}
+
+// A blob of a manifest served before, a blob pushed to the registry, or else
+// a layer or config of a Docker 1.10+ image
+func (reg *Registry) blob(digest string) (blob, error) {
+	reg.mu.Lock()
+	b, ok := reg.blobs[digest]
+	reg.mu.Unlock()
+
+	if ok {
+		return b, nil
+	}
+
+	if reg.uploadDir != "" {
+		if info, err := os.Stat(reg.blobPath(digest)); err == nil {
+			return blob{file: reg.blobPath(digest), size: info.Size()}, nil
+		}
+	}
+
+	id := remote.ID(digest)
+
+	b, err := reg.keyBlob(remote.LayerPrefix(id), "layer.tar")
+	if err == remote.ErrNoSuchImage {
+		b, err = reg.keyBlob(remote.ImagePrefix(id), "config.json")
+	}
+
+	if err == remote.ErrNoSuchImage {
+		return b, errUnknownDigest
+	}
+	return b, err
+}
+
+func digestOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,303 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dogestry/dogestry/config"
+	"github.com/dogestry/dogestry/remote"
+)
+
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// a registry on a local remote holding a Docker 1.10+ image as app:latest
+// and a legacy image with a parent as legacy:v1, pushed like dogestry
+// pushes them. Pushes are accepted if uploadDir is set.
+func makeRegistryServer(t *testing.T, uploadDir string) (*httptest.Server, string, string) {
+	dir, err := ioutil.TempDir("", "dogestry-remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stage, err := ioutil.TempDir("", "dogestry-stage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stage)
+
+	imageConfig := fmt.Sprintf(`{"rootfs":{"type":"layers","diff_ids":["sha256:%s"]}}`, sha256Hex("app layer"))
+	id := sha256Hex(imageConfig)
+
+	files := map[string]string{
+		"images/" + id + "/config.json":                   imageConfig,
+		"layers/" + sha256Hex("app layer") + "/layer.tar": "app layer",
+		"images/base/json":                                `{"id":"base","created":"2015-01-01T00:00:00Z","container_config":{"Cmd":["/bin/sh","-c","#(nop) ADD file"]}}`,
+		"images/base/layer.tar":                           "base layer",
+		"images/base/VERSION":                             "1.0",
+		"images/top/json":                                 `{"id":"top","parent":"base","created":"2015-01-02T00:00:00Z","os":"linux","container_config":{"Cmd":["/bin/sh","-c","make"]}}`,
+		"images/top/layer.tar":                            "top layer",
+		"images/top/VERSION":                              "1.0",
+	}
+
+	for name, content := range files {
+		path := filepath.Join(stage, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := config.Config{}
+	cfg.SetS3URL(dir)
+
+	r, err := remote.NewRemote(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Push("fixture", stage); err != nil {
+		t.Fatal(err)
+	}
+
+	tags := []struct{ repo, tag, id string }{
+		{"app", "latest", id},
+		{"legacy", "v1", "top"},
+		{"legacy", "v2", "top"},
+		{"legacy/nested", "latest", "top"},
+	}
+	for _, tag := range tags {
+		if err := remote.WriteTag(r, tag.repo, tag.tag, remote.ID(tag.id), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := New("", "", Auth{Token: "secret"}, nil, nil)
+	s.Registry = NewRegistry(r, uploadDir)
+
+	return httptest.NewServer(s.router()), dir, id
+}
+
+func registryGet(t *testing.T, ts *httptest.Server, path string, v interface{}) *http.Response {
+	req, err := http.NewRequest("GET", ts.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("docker", "secret")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s should work, got %d: %s", path, resp.StatusCode, body)
+	}
+
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" && digest != "sha256:"+sha256Hex(string(body)) {
+		t.Errorf("GET %s: Docker-Content-Digest %s doesn't match the content", path, digest)
+	}
+
+	if s, ok := v.(*string); ok {
+		*s = string(body)
+	} else if err := json.Unmarshal(body, v); err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+
+	return resp
+}
+
+func TestRegistryRequiresAuth(t *testing.T) {
+	ts, dir, _ := makeRegistryServer(t, "")
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/v2/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Errorf("the registry should ask for credentials, got %d", resp.StatusCode)
+	}
+
+	var empty map[string]interface{}
+	resp = registryGet(t, ts, "/v2/", &empty)
+	if resp.Header.Get("Docker-Distribution-API-Version") != "registry/2.0" {
+		t.Error("the registry should announce the v2 API")
+	}
+}
+
+func TestRegistryTags(t *testing.T) {
+	ts, dir, _ := makeRegistryServer(t, "")
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+
+	var tags struct {
+		Name string
+		Tags []string
+	}
+	registryGet(t, ts, "/v2/legacy/tags/list", &tags)
+
+	if tags.Name != "legacy" || len(tags.Tags) != 2 || tags.Tags[0] != "v1" || tags.Tags[1] != "v2" {
+		t.Errorf("expected the tags of legacy only, got %+v", tags)
+	}
+}
+
+func TestRegistryManifest(t *testing.T) {
+	ts, dir, id := makeRegistryServer(t, "")
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+
+	var manifest manifestV2
+	resp := registryGet(t, ts, "/v2/app/manifests/latest", &manifest)
+
+	if resp.Header.Get("Content-Type") != manifestMediaType {
+		t.Errorf("expected a schema 2 manifest, got %s", resp.Header.Get("Content-Type"))
+	}
+
+	layerDigest := "sha256:" + sha256Hex("app layer")
+	if manifest.Config.Digest != "sha256:"+id || len(manifest.Layers) != 1 || manifest.Layers[0].Digest != layerDigest || manifest.Layers[0].Size != 9 {
+		t.Fatalf("the manifest should point at the stored config and layer, got %+v", manifest)
+	}
+
+	var layer string
+	registryGet(t, ts, "/v2/app/blobs/"+layerDigest, &layer)
+	if layer != "app layer" {
+		t.Errorf("expected the layer, got %q", layer)
+	}
+
+	var imageConfig map[string]interface{}
+	registryGet(t, ts, "/v2/app/blobs/"+manifest.Config.Digest, &imageConfig)
+}
+
+func TestRegistryLegacyManifest(t *testing.T) {
+	ts, dir, _ := makeRegistryServer(t, "")
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+
+	var manifest manifestV2
+	resp := registryGet(t, ts, "/v2/legacy/manifests/v1", &manifest)
+
+	if len(manifest.Layers) != 2 || manifest.Layers[0].Digest != "sha256:"+sha256Hex("base layer") || manifest.Layers[1].Digest != "sha256:"+sha256Hex("top layer") {
+		t.Fatalf("the layers should be listed base first, got %+v", manifest.Layers)
+	}
+
+	var imageConfig struct {
+		ID     string `json:"id"`
+		Parent string `json:"parent"`
+		OS     string `json:"os"`
+		RootFS struct {
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+		History []struct {
+			CreatedBy string `json:"created_by"`
+		} `json:"history"`
+	}
+	registryGet(t, ts, "/v2/legacy/blobs/"+manifest.Config.Digest, &imageConfig)
+
+	if imageConfig.ID != "" || imageConfig.Parent != "" || imageConfig.OS != "linux" {
+		t.Errorf("the config should be made from the image's json, less its id and parent, got %+v", imageConfig)
+	}
+	if len(imageConfig.RootFS.DiffIDs) != 2 || imageConfig.RootFS.DiffIDs[1] != manifest.Layers[1].Digest {
+		t.Errorf("the config should list the layers, got %v", imageConfig.RootFS.DiffIDs)
+	}
+	if len(imageConfig.History) != 2 || imageConfig.History[1].CreatedBy != "/bin/sh -c make" {
+		t.Errorf("the config should have the history of the image, got %+v", imageConfig.History)
+	}
+
+	var layer string
+	registryGet(t, ts, "/v2/legacy/blobs/"+manifest.Layers[0].Digest, &layer)
+	if layer != "base layer" {
+		t.Errorf("expected the base layer, got %q", layer)
+	}
+
+	// pulls by digest get the same manifest
+	var byDigest manifestV2
+	registryGet(t, ts, "/v2/legacy/manifests/"+resp.Header.Get("Docker-Content-Digest"), &byDigest)
+	if byDigest.Config.Digest != manifest.Config.Digest {
+		t.Errorf("expected the same manifest by digest, got %+v", byDigest)
+	}
+}
+
+func TestRegistryUnknown(t *testing.T) {
+	ts, dir, _ := makeRegistryServer(t, "")
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+
+	paths := []string{
+		"/v2/app/manifests/missing",
+		"/v2/missing/tags/list",
+		"/v2/app/blobs/sha256:" + sha256Hex("missing"),
+		"/v2/app/manifests/sha256:" + sha256Hex("missing"),
+	}
+
+	for _, path := range paths {
+		req, _ := http.NewRequest("GET", ts.URL+path, nil)
+		req.SetBasicAuth("docker", "secret")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %s should be not found, got %d", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestRegistryCacheBounded(t *testing.T) {
+	reg := NewRegistry(nil, "")
+
+	shared := blob{data: []byte("shared"), size: 6}
+	reg.cacheManifest("first", []byte("first"), map[string]blob{"shared": shared, "own": {}})
+	reg.cacheManifest("second", []byte("second"), map[string]blob{"shared": shared})
+
+	// asked for again, so it outlives the second
+	if _, ok := reg.cachedManifest("first"); !ok {
+		t.Fatal("the first manifest should be cached")
+	}
+
+	for i := 0; i < maxCachedManifests-1; i++ {
+		reg.cacheManifest(fmt.Sprint(i), nil, nil)
+	}
+
+	if _, ok := reg.cachedManifest("second"); ok {
+		t.Error("the least recently used manifest should be dropped")
+	}
+	if _, ok := reg.cachedManifest("first"); !ok {
+		t.Error("a recently used manifest should be kept")
+	}
+	if _, ok := reg.blobs["shared"]; !ok {
+		t.Error("a blob still listed by a cached manifest should be kept")
+	}
+
+	for i := 0; i < maxCachedManifests; i++ {
+		reg.cacheManifest(fmt.Sprint("later", i), nil, nil)
+	}
+
+	if len(reg.blobs) != 0 || len(reg.blobRefs) != 0 || len(reg.manifests) != maxCachedManifests {
+		t.Errorf("the blobs of dropped manifests should be dropped, got %v", reg.blobs)
+	}
+}
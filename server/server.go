@@ -1,13 +1,16 @@
 package server
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
+	"sync"
 
 	"github.com/dogestry/dogestry/cli"
 	"github.com/dogestry/dogestry/config"
+	"github.com/dogestry/dogestry/remote"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 )
@@ -28,13 +31,31 @@ type JSONStatus struct {
 type Server struct {
 	ListenAddress string
 	TempDir       string
+	Auth          Auth
+
+	// config with the server's own AWS credentials, nil if it has none
+	Config *config.Config
+
+	// serve HTTPS with this config, plain HTTP if nil
+	TLSConfig *tls.Config
+
+	// serve the registry API with this, not at all if nil
+	Registry *Registry
+
+	// running pulls by pullKey
+	pulls   map[string]*pullJob
+	pullsMu sync.Mutex
 }
 
-func New(listenAddress string, tempDir string) *Server {
+func New(listenAddress string, tempDir string, auth Auth, cfg *config.Config, tlsConfig *tls.Config) *Server {
 	s := &Server{}
 
 	s.ListenAddress = listenAddress
 	s.TempDir = tempDir
+	s.Auth = auth
+	s.Config = cfg
+	s.TLSConfig = tlsConfig
+	s.pulls = make(map[string]*pullJob)
 
 	return s
 }
@@ -71,34 +92,47 @@ func (s *Server) pullHandler(response http.ResponseWriter, req *http.Request) {
 
 	response.Header().Set("Content-Type", "application/json")
 
-	cfg, err := config.NewServerConfig(req.Header.Get("X-Registry-Auth"))
+	cfg, status, err := s.pullConfig(req)
 	if err != nil {
+		fmt.Printf("Refused pull request: %v\n", err)
+		response.WriteHeader(status)
 		response.Write(s.errorJSON(err.Error()))
 		return
 	}
 
-	dogestryCli, err := cli.NewDogestryCli(cfg, make([]string, 0), s.TempDir)
+	image := req.URL.Query().Get("fromImage")
+
+	// pulls of the same image share one job, resolved first so a tag that
+	// moved on isn't served by a pull of the old image
+	r, err := remote.NewRemote(cfg)
 	if err != nil {
 		response.Write(s.errorJSON(err.Error()))
 		return
 	}
 
-	image := req.URL.Query().Get("fromImage")
-
-	response.Write(s.statusJSON(fmt.Sprintf("Pulling %s from S3...", image)))
-
-	// Try to flush
-	if f, ok := response.(http.Flusher); ok {
-		f.Flush()
-	}
-
-	if err := dogestryCli.CmdPull(cfg.AWS.S3URL.String(), image); err != nil {
-		fmt.Printf("Error pulling image from S3: %v\n", err.Error())
+	id, err := r.ResolveImageNameToId(image)
+	if err != nil {
 		response.Write(s.errorJSON("Dogestry server error: " + err.Error()))
 		return
 	}
 
-	response.Write(s.statusJSON("Done"))
+	key := pullKey(cfg, image, string(id))
+	job, started := s.startPull(key)
+
+	if started {
+		dogestryCli, err := cli.NewDogestryCli(cfg, make([]string, 0), s.TempDir)
+		if err != nil {
+			s.endPull(key)
+			job.finish(s.errorJSON(err.Error()))
+		} else {
+			go s.runPull(job, key, dogestryCli, cfg, image)
+		}
+	} else {
+		fmt.Printf("Pull of %s (%s) already running, waiting for it\n", image, id.Short())
+		response.Write(s.statusJSON(fmt.Sprintf("Pull of %s already running, waiting for it...", image)))
+	}
+
+	job.stream(response)
 }
 
 func (s *Server) healthCheckHandler(response http.ResponseWriter, req *http.Request) {
@@ -113,16 +147,52 @@ func (s *Server) rootHandler(response http.ResponseWriter, req *http.Request) {
 	response.Write(s.errorJSON("Dogestry API, nothing to see here..."))
 }
 
-func (s *Server) ServeHttp() {
+// Docker registry clients authenticate with the token as the password of
+// basic auth, or with a client certificate
+func (s *Server) registryAuth(handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, req *http.Request) {
+		response.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+
+		if !s.authenticated(req) {
+			response.Header().Set("WWW-Authenticate", `Basic realm="dogestry"`)
+			writeRegistryError(response, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+			return
+		}
+
+		handler(response, req)
+	})
+}
+
+func (s *Server) router() *mux.Router {
 	router := mux.NewRouter()
 
 	router.Handle("/{version}/images/create", http.HandlerFunc(s.pullHandler)).Methods("POST")
 	router.Handle("/status/check", http.HandlerFunc(s.healthCheckHandler)).Methods("GET")
 	router.Handle("/", http.HandlerFunc(s.rootHandler)).Methods("GET")
 
-	http.Handle("/", handlers.LoggingHandler(os.Stdout, router))
+	if s.Registry != nil {
+		s.Registry.routes(router, s.registryAuth)
+	}
+
+	return router
+}
+
+func (s *Server) ServeHttp() {
+	http.Handle("/", handlers.LoggingHandler(os.Stdout, s.router()))
+
+	httpServer := &http.Server{
+		Addr:      s.ListenAddress,
+		TLSConfig: s.TLSConfig,
+	}
+
+	var err error
+	if s.TLSConfig != nil {
+		// the certificate is in TLSConfig already
+		err = httpServer.ListenAndServeTLS("", "")
+	} else {
+		err = httpServer.ListenAndServe()
+	}
 
-	err := http.ListenAndServe(s.ListenAddress, nil)
 	if err != nil {
 		fmt.Println("Can't start HTTP server: " + err.Error())
 		os.Exit(1)
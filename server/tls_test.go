@@ -0,0 +1,138 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dogestry/dogestry/utils"
+)
+
+// writes a certificate and its key to dir as name.pem and name-key.pem,
+// signed by parent (self-signed if nil)
+func writeCert(t *testing.T, dir, name string, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".pem"), certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func certTemplate(serial int64, name string) *x509.Certificate {
+	return &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+}
+
+func TestTLSClientCertificateAuthenticates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dogestry-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caTemplate := certTemplate(1, "dogestry ca")
+	caTemplate.IsCA = true
+	caTemplate.BasicConstraintsValid = true
+	caTemplate.KeyUsage = x509.KeyUsageCertSign
+	ca, caKey := writeCert(t, dir, "ca", caTemplate, nil, nil)
+
+	serverTemplate := certTemplate(2, "dogestry server")
+	serverTemplate.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	serverTemplate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	writeCert(t, dir, "server", serverTemplate, ca, caKey)
+
+	clientTemplate := certTemplate(3, "dogestry client")
+	clientTemplate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	writeCert(t, dir, "client", clientTemplate, ca, caKey)
+
+	caFile := filepath.Join(dir, "ca.pem")
+
+	serverTLS, err := utils.ServerTLSConfig(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"), caFile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := New("", "", Auth{}, nil, serverTLS)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(response http.ResponseWriter, req *http.Request) {
+		if !s.authenticated(req) {
+			response.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	ts.TLS = s.TLSConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	clientTLS, err := utils.ClientTLSConfig(filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem"), caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("a client with a certificate signed by the CA should connect. Error: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("the client certificate should authenticate, got %d", resp.StatusCode)
+	}
+
+	// without a certificate the handshake fails
+	anonymousTLS, err := utils.ClientTLSConfig("", "", caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: anonymousTLS}}
+	if resp, err := client.Get(ts.URL); err == nil {
+		resp.Body.Close()
+		t.Error("a client without a certificate should be refused with -tlsverify")
+	}
+}
@@ -0,0 +1,555 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/dogestry/dogestry/remote"
+	"github.com/dogestry/dogestry/utils"
+	"github.com/gorilla/mux"
+)
+
+// docker pushes manifests of a few KB, a lot more is not a manifest
+const maxManifestSize = 4 << 20
+
+// uploads and blobs untouched for this long were abandoned by their push
+const uploadExpiry = 24 * time.Hour
+
+// the largest blob that can be uploaded
+var maxUploadSize int64 = 10 << 30
+
+var (
+	uploadIdPattern = regexp.MustCompile(`^[a-f0-9]{32}$`)
+
+	errUploadUnknown     = errors.New("blob upload unknown to registry")
+	errUploadTooLarge    = errors.New("blob upload too large")
+	errManifestInvalid   = errors.New("only schema 2 manifests of Docker 1.10+ images can be pushed")
+	errManifestBlob      = errors.New("blob of the manifest unknown to registry")
+	errLayerDiffMismatch = errors.New("layer doesn't match the diff id in the image config")
+)
+
+// Blobs are uploaded to uploadDir/uploads/<uuid> and kept in
+// uploadDir/blobs/<digest> once complete, until the manifests using them are
+// pushed or they expire.
+// The manifest is pushed to the remote as `dogestry push` would: the config,
+// the layers the remote doesn't have yet uncompressed, then the tag.
+func (reg *Registry) pushRoutes(router *mux.Router, wrap func(http.HandlerFunc) http.Handler) {
+	router.Handle("/v2/{name:.+}/blobs/uploads/", wrap(reg.startUploadHandler)).Methods("POST")
+	router.Handle("/v2/{name:.+}/blobs/uploads/{uuid}", wrap(reg.uploadStatusHandler)).Methods("GET")
+	router.Handle("/v2/{name:.+}/blobs/uploads/{uuid}", wrap(reg.patchUploadHandler)).Methods("PATCH")
+	router.Handle("/v2/{name:.+}/blobs/uploads/{uuid}", wrap(reg.finishUploadHandler)).Methods("PUT")
+	router.Handle("/v2/{name:.+}/blobs/uploads/{uuid}", wrap(reg.cancelUploadHandler)).Methods("DELETE")
+	router.Handle("/v2/{name:.+}/manifests/{reference}", wrap(reg.putManifestHandler)).Methods("PUT")
+}
+
+func (reg *Registry) uploadPath(uuid string) string {
+	return filepath.Join(reg.uploadDir, "uploads", uuid)
+}
+
+func (reg *Registry) blobPath(digest string) string {
+	return filepath.Join(reg.uploadDir, "blobs", remote.ID(digest).String())
+}
+
+func newUploadId() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// where the client continues the upload, and how much of it the server has
+func writeUploadStatus(response http.ResponseWriter, name, uuid string, size int64, status int) {
+	end := size - 1
+	if end < 0 {
+		end = 0
+	}
+
+	response.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", name, uuid))
+	response.Header().Set("Docker-Upload-UUID", uuid)
+	response.Header().Set("Range", fmt.Sprintf("0-%d", end))
+	response.Header().Set("Content-Length", "0")
+	response.WriteHeader(status)
+}
+
+func writeBlobCreated(response http.ResponseWriter, name, digest string) {
+	response.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, digest))
+	response.Header().Set("Docker-Content-Digest", digest)
+	response.Header().Set("Content-Length", "0")
+	response.WriteHeader(http.StatusCreated)
+}
+
+func writeUploadError(response http.ResponseWriter, err error) {
+	switch err {
+	case errUploadUnknown:
+		writeRegistryError(response, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", err.Error())
+	case errUploadTooLarge:
+		writeRegistryError(response, http.StatusRequestEntityTooLarge, "BLOB_UPLOAD_INVALID", err.Error())
+	case remote.ErrDigestMismatch:
+		writeRegistryError(response, http.StatusBadRequest, "DIGEST_INVALID", "provided digest did not match uploaded content")
+	default:
+		writeRegistryError(response, http.StatusInternalServerError, "UNKNOWN", err.Error())
+	}
+}
+
+// Starts an upload. Blobs the registry has already are mounted straight
+// away, and whole blobs can be uploaded at once with their digest.
+func (reg *Registry) startUploadHandler(response http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["name"]
+	if !repoNamePattern.MatchString(name) {
+		writeRegistryError(response, http.StatusBadRequest, "NAME_INVALID", "invalid repository name")
+		return
+	}
+
+	if mount := req.URL.Query().Get("mount"); digestPattern.MatchString(mount) {
+		if _, err := reg.blob(mount); err == nil {
+			writeBlobCreated(response, name, mount)
+			return
+		}
+	}
+
+	reg.expireUploads()
+
+	uuid, err := newUploadId()
+	if err != nil {
+		writeUploadError(response, err)
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(reg.uploadPath(uuid)), 0700); err != nil {
+		writeUploadError(response, err)
+		return
+	}
+
+	size, err := reg.appendUpload(uuid, req.Body, true)
+	if err != nil {
+		writeUploadError(response, err)
+		return
+	}
+
+	if digest := req.URL.Query().Get("digest"); digest != "" {
+		reg.finishUpload(response, name, uuid, digest)
+		return
+	}
+
+	writeUploadStatus(response, name, uuid, size, http.StatusAccepted)
+}
+
+func (reg *Registry) uploadStatusHandler(response http.ResponseWriter, req *http.Request) {
+	name, uuid := mux.Vars(req)["name"], mux.Vars(req)["uuid"]
+
+	size, err := reg.uploadSize(uuid)
+	if err != nil {
+		writeUploadError(response, err)
+		return
+	}
+
+	writeUploadStatus(response, name, uuid, size, http.StatusNoContent)
+}
+
+func (reg *Registry) patchUploadHandler(response http.ResponseWriter, req *http.Request) {
+	name, uuid := mux.Vars(req)["name"], mux.Vars(req)["uuid"]
+
+	reg.expireUploads()
+
+	size, err := reg.appendUpload(uuid, req.Body, false)
+	if err != nil {
+		writeUploadError(response, err)
+		return
+	}
+
+	writeUploadStatus(response, name, uuid, size, http.StatusAccepted)
+}
+
+// Completes an upload with its last chunk, if any, and checks its digest
+func (reg *Registry) finishUploadHandler(response http.ResponseWriter, req *http.Request) {
+	name, uuid := mux.Vars(req)["name"], mux.Vars(req)["uuid"]
+
+	reg.expireUploads()
+
+	if _, err := reg.appendUpload(uuid, req.Body, false); err != nil {
+		writeUploadError(response, err)
+		return
+	}
+
+	reg.finishUpload(response, name, uuid, req.URL.Query().Get("digest"))
+}
+
+func (reg *Registry) finishUpload(response http.ResponseWriter, name, uuid, digest string) {
+	if !digestPattern.MatchString(digest) {
+		os.Remove(reg.uploadPath(uuid))
+		writeRegistryError(response, http.StatusBadRequest, "DIGEST_INVALID", "invalid digest")
+		return
+	}
+
+	uploadPath := reg.uploadPath(uuid)
+
+	sum, err := utils.Sha256File(uploadPath)
+	if err == nil && "sha256:"+sum != digest {
+		err = remote.ErrDigestMismatch
+	}
+
+	if err == nil {
+		if err = os.MkdirAll(filepath.Dir(reg.blobPath(digest)), 0700); err == nil {
+			err = os.Rename(uploadPath, reg.blobPath(digest))
+		}
+	}
+
+	if err != nil {
+		os.Remove(uploadPath)
+		writeUploadError(response, err)
+		return
+	}
+
+	writeBlobCreated(response, name, digest)
+}
+
+func (reg *Registry) cancelUploadHandler(response http.ResponseWriter, req *http.Request) {
+	uuid := mux.Vars(req)["uuid"]
+
+	if _, err := reg.uploadSize(uuid); err != nil {
+		writeUploadError(response, err)
+		return
+	}
+
+	os.Remove(reg.uploadPath(uuid))
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// Remove uploads and blobs of pushes that were given up on, docker doesn't
+// always cancel them. Blobs of manifests being pushed are kept.
+func (reg *Registry) expireUploads() {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	for _, dir := range []string{"uploads", "blobs"} {
+		files, err := ioutil.ReadDir(filepath.Join(reg.uploadDir, dir))
+		if err != nil {
+			continue
+		}
+
+		for _, file := range files {
+			if dir == "blobs" && reg.held[file.Name()] != nil {
+				continue
+			}
+			if time.Since(file.ModTime()) > uploadExpiry {
+				os.Remove(filepath.Join(reg.uploadDir, dir, file.Name()))
+			}
+		}
+	}
+}
+
+// A pushed blob in use by manifest pushes
+type heldBlob struct {
+	pushes int
+	pushed bool
+}
+
+// Keep the blobs of digests until released, expiry and other pushes leave them
+func (reg *Registry) holdBlobs(digests []string) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	for _, digest := range digests {
+		hex := remote.ID(digest).String()
+		if reg.held[hex] == nil {
+			reg.held[hex] = &heldBlob{}
+		}
+		reg.held[hex].pushes++
+	}
+}
+
+// Let go of the blobs of digests. Once a push has put them on the remote,
+// the last push holding them removes them.
+func (reg *Registry) releaseBlobs(digests []string, pushed bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	for _, digest := range digests {
+		hex := remote.ID(digest).String()
+		held := reg.held[hex]
+		held.pushed = held.pushed || pushed
+
+		if held.pushes--; held.pushes == 0 {
+			delete(reg.held, hex)
+			if held.pushed {
+				os.Remove(reg.blobPath(digest))
+			}
+		}
+	}
+}
+
+func (reg *Registry) uploadSize(uuid string) (int64, error) {
+	if !uploadIdPattern.MatchString(uuid) {
+		return 0, errUploadUnknown
+	}
+
+	info, err := os.Stat(reg.uploadPath(uuid))
+	if os.IsNotExist(err) {
+		return 0, errUploadUnknown
+	} else if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), nil
+}
+
+// append body to the upload uuid, creating it if create is set, and return
+// the size of the upload so far
+func (reg *Registry) appendUpload(uuid string, body io.Reader, create bool) (int64, error) {
+	flags := os.O_WRONLY | os.O_APPEND
+	if create {
+		flags |= os.O_CREATE | os.O_EXCL
+	} else if _, err := reg.uploadSize(uuid); err != nil {
+		return 0, err
+	}
+
+	file, err := os.OpenFile(reg.uploadPath(uuid), flags, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	// a byte past the limit tells the upload is too large
+	written, err := io.Copy(file, io.LimitReader(body, maxUploadSize-info.Size()+1))
+	if err != nil {
+		return 0, err
+	}
+
+	size := info.Size() + written
+	if size > maxUploadSize {
+		os.Remove(reg.uploadPath(uuid))
+		return 0, errUploadTooLarge
+	}
+
+	return size, nil
+}
+
+func (reg *Registry) putManifestHandler(response http.ResponseWriter, req *http.Request) {
+	name, reference := mux.Vars(req)["name"], mux.Vars(req)["reference"]
+
+	if !repoNamePattern.MatchString(name) {
+		writeRegistryError(response, http.StatusBadRequest, "NAME_INVALID", "invalid repository name")
+		return
+	}
+
+	if !tagPattern.MatchString(reference) && !digestPattern.MatchString(reference) {
+		writeRegistryError(response, http.StatusBadRequest, "MANIFEST_INVALID", "invalid tag or digest")
+		return
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(req.Body, maxManifestSize))
+	if err != nil {
+		writeUploadError(response, err)
+		return
+	}
+
+	// digest references are only checked, the image isn't tagged
+	tag := reference
+	if digestPattern.MatchString(reference) {
+		if digestOf(data) != reference {
+			writeRegistryError(response, http.StatusBadRequest, "DIGEST_INVALID", "manifest doesn't match its digest")
+			return
+		}
+		tag = ""
+	}
+
+	manifest, err := reg.pushManifest(name, tag, data)
+	switch err {
+	case nil:
+	case errManifestInvalid, errLayerDiffMismatch:
+		writeRegistryError(response, http.StatusBadRequest, "MANIFEST_INVALID", err.Error())
+		return
+	case errManifestBlob:
+		writeRegistryError(response, http.StatusBadRequest, "MANIFEST_BLOB_UNKNOWN", err.Error())
+		return
+	default:
+		fmt.Printf("Error pushing manifest %s:%s: %v\n", name, reference, err)
+		writeRegistryError(response, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+
+	// the manifest served for the image, which has its layers uncompressed
+	digest := digestOf(manifest)
+
+	response.Header().Set("Location", fmt.Sprintf("/v2/%s/manifests/%s", name, digest))
+	response.Header().Set("Docker-Content-Digest", digest)
+	response.Header().Set("Content-Length", "0")
+	response.WriteHeader(http.StatusCreated)
+}
+
+// Push the image of a schema 2 manifest to the remote and tag it, if tag
+// isn't empty. Returns the manifest the registry serves for the image.
+func (reg *Registry) pushManifest(name, tag string, data []byte) ([]byte, error) {
+	var manifest manifestV2
+	if err := json.Unmarshal(data, &manifest); err != nil || manifest.SchemaVersion != 2 || manifest.MediaType != manifestMediaType {
+		return nil, errManifestInvalid
+	}
+
+	if !digestPattern.MatchString(manifest.Config.Digest) {
+		return nil, errManifestInvalid
+	}
+
+	digests := []string{manifest.Config.Digest}
+	for _, layer := range manifest.Layers {
+		if digestPattern.MatchString(layer.Digest) {
+			digests = append(digests, layer.Digest)
+		}
+	}
+
+	pushed := false
+	reg.holdBlobs(digests)
+	defer func() {
+		reg.releaseBlobs(digests, pushed)
+	}()
+
+	configJson, err := reg.readBlob(manifest.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := remote.ParseImageConfig(configJson)
+	if err != nil {
+		return nil, errManifestInvalid
+	}
+
+	layers := config.Layers()
+	if len(layers) != len(manifest.Layers) {
+		return nil, errManifestInvalid
+	}
+
+	stage, err := ioutil.TempDir(reg.uploadDir, "push")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(stage)
+
+	// stored and tagged by the bare hex, like images pushed by dogestry
+	id := remote.ID(remote.ID(manifest.Config.Digest).String())
+
+	configPath := filepath.Join(stage, filepath.FromSlash(remote.ImagePrefix(id)), "config.json")
+	if err := writeStagedFile(configPath, bytes.NewReader(configJson)); err != nil {
+		return nil, err
+	}
+
+	for i, layer := range layers {
+		exists, err := reg.remote.LayerExists(layer)
+		if err != nil {
+			return nil, err
+		} else if exists {
+			continue
+		}
+
+		digest := manifest.Layers[i].Digest
+		if !digestPattern.MatchString(digest) {
+			return nil, errManifestInvalid
+		}
+
+		layerPath := filepath.Join(stage, filepath.FromSlash(remote.LayerPrefix(layer)), "layer.tar")
+		if err := stageLayer(reg.blobPath(digest), layerPath, layer); err != nil {
+			return nil, err
+		}
+	}
+
+	fmt.Printf("Pushing image %s of %s to %s\n", id.Short(), name, reg.remote.Desc())
+	if err := reg.remote.Push(name, stage); err != nil {
+		return nil, err
+	}
+
+	if tag != "" {
+		if err := remote.WriteTag(reg.remote, name, tag, id, reg.uploadDir); err != nil {
+			return nil, err
+		}
+	}
+
+	// on the remote now, including the layers it had already
+	pushed = true
+
+	return reg.manifest(id)
+}
+
+// An uploaded blob, or a config already on the remote
+func (reg *Registry) readBlob(digest string) ([]byte, error) {
+	data, err := ioutil.ReadFile(reg.blobPath(digest))
+	if os.IsNotExist(err) {
+		data, err = reg.readKey(remote.ImagePrefix(remote.ID(digest)) + "config.json")
+		if err != nil {
+			return nil, errManifestBlob
+		}
+	}
+
+	if err == nil && digestOf(data) != digest {
+		return nil, remote.ErrDigestMismatch
+	}
+
+	return data, err
+}
+
+// Stage the uploaded layer in blobPath at dst, uncompressed, checking it
+// against its diff id
+func stageLayer(blobPath, dst string, diffId remote.ID) error {
+	file, err := os.Open(blobPath)
+	if os.IsNotExist(err) {
+		return errManifestBlob
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var reader io.Reader = bufio.NewReader(file)
+
+	// docker pushes layers gzipped
+	if magic, err := reader.(*bufio.Reader).Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+
+	hash := sha256.New()
+	if err := writeStagedFile(dst, io.TeeReader(reader, hash)); err != nil {
+		return err
+	}
+
+	if hex.EncodeToString(hash.Sum(nil)) != diffId.String() {
+		return errLayerDiffMismatch
+	}
+
+	return nil
+}
+
+func writeStagedFile(path string, reader io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, reader)
+	return err
+}
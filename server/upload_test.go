@@ -0,0 +1,315 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func registryDo(t *testing.T, ts *httptest.Server, method, path string, body []byte) *http.Response {
+	req, err := http.NewRequest(method, ts.URL+path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("docker", "secret")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	return resp
+}
+
+func gzipped(t *testing.T, content string) []byte {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func makePushServer(t *testing.T) (*httptest.Server, string, string) {
+	uploadDir, err := ioutil.TempDir("", "dogestry-uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts, dir, _ := makeRegistryServer(t, uploadDir)
+	return ts, dir, uploadDir
+}
+
+// uploads content in two chunks and returns its digest
+func uploadBlob(t *testing.T, ts *httptest.Server, name string, content []byte) string {
+	digest := "sha256:" + sha256Hex(string(content))
+
+	resp := registryDo(t, ts, "POST", "/v2/"+name+"/blobs/uploads/", nil)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("starting an upload should be accepted, got %d", resp.StatusCode)
+	}
+	location := resp.Header.Get("Location")
+
+	half := len(content) / 2
+	resp = registryDo(t, ts, "PATCH", location, content[:half])
+	if resp.StatusCode != http.StatusAccepted || resp.Header.Get("Range") != fmt.Sprintf("0-%d", half-1) {
+		t.Fatalf("a chunk should be accepted, got %d with range %s", resp.StatusCode, resp.Header.Get("Range"))
+	}
+
+	resp = registryDo(t, ts, "PUT", location+"?digest="+digest, content[half:])
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Docker-Content-Digest") != digest {
+		t.Fatalf("finishing the upload should create the blob, got %d", resp.StatusCode)
+	}
+
+	return digest
+}
+
+func pushedManifest(configDigest string, configSize int, layerDigest string, layerSize int) []byte {
+	manifest := manifestV2{
+		SchemaVersion: 2,
+		MediaType:     manifestMediaType,
+		Config:        descriptor{MediaType: configMediaType, Size: int64(configSize), Digest: configDigest},
+		Layers:        []descriptor{{MediaType: "application/vnd.docker.image.rootfs.diff.tar.gzip", Size: int64(layerSize), Digest: layerDigest}},
+	}
+	data, _ := json.Marshal(manifest)
+	return data
+}
+
+func TestRegistryPush(t *testing.T) {
+	ts, dir, uploadDir := makePushServer(t)
+	defer os.RemoveAll(dir)
+	defer os.RemoveAll(uploadDir)
+	defer ts.Close()
+
+	layer := gzipped(t, "pushed layer")
+	layerDigest := uploadBlob(t, ts, "pushed", layer)
+
+	imageConfig := []byte(fmt.Sprintf(`{"os":"linux","rootfs":{"type":"layers","diff_ids":["sha256:%s"]}}`, sha256Hex("pushed layer")))
+	configDigest := "sha256:" + sha256Hex(string(imageConfig))
+
+	// the config in one go
+	resp := registryDo(t, ts, "POST", "/v2/pushed/blobs/uploads/?digest="+configDigest, imageConfig)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("a monolithic upload should create the blob, got %d", resp.StatusCode)
+	}
+
+	resp = registryDo(t, ts, "PUT", "/v2/pushed/manifests/latest", pushedManifest(configDigest, len(imageConfig), layerDigest, len(layer)))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("pushing the manifest should create it, got %d", resp.StatusCode)
+	}
+
+	id := sha256Hex(string(imageConfig))
+	expected := map[string]string{
+		"layers/" + sha256Hex("pushed layer") + "/layer.tar": "pushed layer",
+		"images/" + id + "/config.json":                      string(imageConfig),
+		"repositories/pushed/latest":                         id,
+	}
+	for name, content := range expected {
+		data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil || string(data) != content {
+			t.Errorf("the push should store %s as %q, got %q (%v)", name, content, data, err)
+		}
+	}
+
+	var manifest manifestV2
+	resp = registryGet(t, ts, "/v2/pushed/manifests/latest", &manifest)
+	if resp.Header.Get("Docker-Content-Digest") == "" || manifest.Config.Digest != configDigest {
+		t.Errorf("the pushed image should be served, got %+v", manifest)
+	}
+
+	var stored string
+	registryGet(t, ts, "/v2/pushed/blobs/"+manifest.Layers[0].Digest, &stored)
+	if stored != "pushed layer" {
+		t.Errorf("the layer should be served uncompressed, got %q", stored)
+	}
+}
+
+func TestRegistryPushDigestMismatch(t *testing.T) {
+	ts, dir, uploadDir := makePushServer(t)
+	defer os.RemoveAll(dir)
+	defer os.RemoveAll(uploadDir)
+	defer ts.Close()
+
+	resp := registryDo(t, ts, "POST", "/v2/pushed/blobs/uploads/?digest=sha256:"+sha256Hex("something else"), []byte("content"))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("an upload not matching its digest should be refused, got %d", resp.StatusCode)
+	}
+}
+
+func TestRegistryPushBadManifest(t *testing.T) {
+	ts, dir, uploadDir := makePushServer(t)
+	defer os.RemoveAll(dir)
+	defer os.RemoveAll(uploadDir)
+	defer ts.Close()
+
+	layer := gzipped(t, "pushed layer")
+	layerDigest := uploadBlob(t, ts, "pushed", layer)
+
+	// the config lists a different layer
+	imageConfig := []byte(fmt.Sprintf(`{"rootfs":{"type":"layers","diff_ids":["sha256:%s"]}}`, sha256Hex("another layer")))
+	configDigest := uploadBlob(t, ts, "pushed", imageConfig)
+
+	resp := registryDo(t, ts, "PUT", "/v2/pushed/manifests/latest", pushedManifest(configDigest, len(imageConfig), layerDigest, len(layer)))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("a layer not matching the config should be refused, got %d", resp.StatusCode)
+	}
+
+	// a layer that was never uploaded
+	resp = registryDo(t, ts, "PUT", "/v2/pushed/manifests/latest", pushedManifest(configDigest, len(imageConfig), "sha256:"+sha256Hex("missing"), 7))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("a manifest with an unknown blob should be refused, got %d", resp.StatusCode)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "repositories", "pushed")); !os.IsNotExist(err) {
+		t.Error("a refused manifest shouldn't tag anything")
+	}
+}
+
+// the files left in dir, not counting directories
+func filesIn(t *testing.T, dir string) []string {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files = append(files, path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestRegistryPushExistingLayers(t *testing.T) {
+	ts, dir, uploadDir := makePushServer(t)
+	defer os.RemoveAll(dir)
+	defer os.RemoveAll(uploadDir)
+	defer ts.Close()
+
+	// the remote has this layer already
+	layer := gzipped(t, "app layer")
+	layerDigest := uploadBlob(t, ts, "app", layer)
+
+	imageConfig := []byte(fmt.Sprintf(`{"os":"linux","rootfs":{"type":"layers","diff_ids":["sha256:%s"]}}`, sha256Hex("app layer")))
+	configDigest := uploadBlob(t, ts, "app", imageConfig)
+
+	resp := registryDo(t, ts, "PUT", "/v2/app/manifests/v2", pushedManifest(configDigest, len(imageConfig), layerDigest, len(layer)))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("pushing the manifest should create it, got %d", resp.StatusCode)
+	}
+
+	if files := filesIn(t, uploadDir); len(files) != 0 {
+		t.Errorf("every blob of the manifest should be removed after the push, got %v", files)
+	}
+}
+
+func TestExpireUploads(t *testing.T) {
+	uploadDir, err := ioutil.TempDir("", "dogestry-uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(uploadDir)
+
+	reg := NewRegistry(nil, uploadDir)
+
+	old := time.Now().Add(-2 * uploadExpiry)
+	for _, name := range []string{"uploads/stale", "blobs/stale", "uploads/fresh", "blobs/fresh"} {
+		path := filepath.Join(uploadDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Base(name) == "stale" {
+			if err := os.Chtimes(path, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	reg.expireUploads()
+
+	files := filesIn(t, uploadDir)
+	if len(files) != 2 || filepath.Base(files[0]) != "fresh" || filepath.Base(files[1]) != "fresh" {
+		t.Errorf("only the stale uploads and blobs should be removed, got %v", files)
+	}
+}
+
+func TestHeldBlobs(t *testing.T) {
+	uploadDir, err := ioutil.TempDir("", "dogestry-uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(uploadDir)
+
+	reg := NewRegistry(nil, uploadDir)
+
+	digest := "sha256:" + sha256Hex("shared layer")
+	path := reg.blobPath(digest)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte("shared layer"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * uploadExpiry)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	// two pushes of manifests sharing the blob
+	reg.holdBlobs([]string{digest})
+	reg.holdBlobs([]string{digest})
+
+	reg.expireUploads()
+	reg.releaseBlobs([]string{digest}, true)
+
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal("a blob held by a push shouldn't expire or be removed by another push")
+	}
+
+	reg.releaseBlobs([]string{digest}, false)
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("the blob should be removed by the last push once it's on the remote")
+	}
+}
+
+func TestRegistryUploadTooLarge(t *testing.T) {
+	ts, dir, uploadDir := makePushServer(t)
+	defer os.RemoveAll(dir)
+	defer os.RemoveAll(uploadDir)
+	defer ts.Close()
+
+	defer func(size int64) { maxUploadSize = size }(maxUploadSize)
+	maxUploadSize = 8
+
+	resp := registryDo(t, ts, "POST", "/v2/pushed/blobs/uploads/", []byte("12345"))
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("an upload under the limit should be accepted, got %d", resp.StatusCode)
+	}
+
+	resp = registryDo(t, ts, "PATCH", resp.Header.Get("Location"), []byte("6789"))
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("an upload over the limit should be refused, got %d", resp.StatusCode)
+	}
+
+	if files := filesIn(t, uploadDir); len(files) != 0 {
+		t.Errorf("the refused upload should be removed, got %v", files)
+	}
+}
@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Errors keyed by what failed, eg a file or an image id
+type ErrorMap map[string]error
+
+func (e ErrorMap) Error() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	messages := make([]string, 0, len(names))
+	for _, name := range names {
+		messages = append(messages, fmt.Sprintf("%s: %v", name, e[name]))
+	}
+
+	return strings.Join(messages, "; ")
+}
+
+// Parallel calls fn for each of names, running at most n at a time. All of
+// them run even if some fail, the errors are returned keyed by name.
+func Parallel(n int, names []string, fn func(name string) error) ErrorMap {
+	if n < 1 {
+		n = 1
+	}
+
+	errMap := make(ErrorMap)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	namesCh := make(chan string)
+
+	for i := 0; i < n && i < len(names); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range namesCh {
+				if err := fn(name); err != nil {
+					mu.Lock()
+					errMap[name] = err
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, name := range names {
+		namesCh <- name
+	}
+	close(namesCh)
+
+	wg.Wait()
+	return errMap
+}
+
+// Limiter caps how many calls of Run are running at once. Pools sharing one
+// stay within it together, however they're nested.
+type Limiter chan struct{}
+
+func NewLimiter(n int) Limiter {
+	if n < 1 {
+		n = 1
+	}
+	return make(Limiter, n)
+}
+
+// Run fn once there's room for it. A nil Limiter doesn't limit.
+func (l Limiter) Run(fn func() error) error {
+	if l == nil {
+		return fn()
+	}
+
+	l <- struct{}{}
+	defer func() { <-l }()
+
+	return fn()
+}
@@ -0,0 +1,13 @@
+package utils
+
+import "os"
+
+// IsTerminal tells whether f is a terminal rather than a file or a pipe
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	return info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// ClientTLSConfig presents the certificate in certFile/keyFile, if given, and
+// trusts the CAs in caFile instead of the system's, if given.
+func ClientTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load TLS certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
+
+// ServerTLSConfig serves the certificate in certFile/keyFile. Client
+// certificates are checked against the CAs in caFile: when given, or always
+// with verifyClients.
+func ServerTLSConfig(certFile, keyFile, caFile string, verifyClients bool) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("Both a TLS certificate and key are needed")
+	}
+
+	if verifyClients && caFile == "" {
+		return nil, errors.New("Verifying client certificates needs a CA certificate")
+	}
+
+	tlsConfig, err := ClientTLSConfig(certFile, keyFile, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+
+		if verifyClients {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read CA certificate: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("No certificates found in %s", caFile)
+	}
+
+	return pool, nil
+}
@@ -4,8 +4,11 @@ import (
 	"bufio"
 	"crypto/md5"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -44,33 +47,32 @@ func FileHumanSize(path string) string {
 
 // md5 file at path
 func Md5File(path string) (string, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return "", nil
-	}
-	defer f.Close()
-
-	// files could be pretty big, lets buffer
-	buff := bufio.NewReader(f)
-	hash := md5.New()
-
-	io.Copy(hash, buff)
-	return hex.EncodeToString(hash.Sum(nil)), nil
+	return hashFile(path, md5.New())
 }
 
 // sha1 file at path
 func Sha1File(path string) (string, error) {
+	return hashFile(path, sha1.New())
+}
+
+// sha256 file at path
+func Sha256File(path string) (string, error) {
+	return hashFile(path, sha256.New())
+}
+
+func hashFile(path string, hash hash.Hash) (string, error) {
 	f, err := os.Open(path)
 	if err != nil {
-		return "", nil
+		return "", err
 	}
 	defer f.Close()
 
 	// files could be pretty big, lets buffer
 	buff := bufio.NewReader(f)
-	hash := sha1.New()
 
-	io.Copy(hash, buff)
+	if _, err := io.Copy(hash, buff); err != nil {
+		return "", err
+	}
 	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
@@ -101,16 +103,23 @@ func ParseHosts(pullHosts []string) map[string]int {
 	return parsedHosts
 }
 
-// Check if docker (or dogestry) is running on the endpoint
-func ServerCheck(host string, port int, timeout time.Duration, docker bool) bool {
-	url := fmt.Sprintf("http://%v:%v/version", host, port)
+// Check if docker (or dogestry) is running on the endpoint. With tlsConfig
+// the endpoint is checked over HTTPS.
+func ServerCheck(host string, port int, timeout time.Duration, docker bool, tlsConfig *tls.Config) bool {
+	scheme := "http"
+	if tlsConfig != nil {
+		scheme = "https"
+	}
+
+	url := fmt.Sprintf("%v://%v:%v/version", scheme, host, port)
 
 	if !docker {
-		url = fmt.Sprintf("http://%v:%v/status/check", host, port)
+		url = fmt.Sprintf("%v://%v:%v/status/check", scheme, host, port)
 	}
 
 	client := http.Client{
-		Timeout: timeout,
+		Timeout:   timeout,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
 	}
 
 	resp, getErr := client.Get(url)